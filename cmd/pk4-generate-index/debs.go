@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/Debian/pk4/internal/index"
+	"github.com/Debian/pk4/internal/write"
+	"pault.ag/go/debian/control"
+)
+
+func genDebIndex(bindex []control.BinaryIndex, target indexTarget) index.Debs {
+	idx := make(index.Debs)
+
+	for _, pkg := range bindex {
+		if pkg.Filename == "" {
+			continue // e.g. a locally built package
+		}
+		src, ok := sourceOf(pkg)
+		if !ok {
+			continue // malformed Source value
+		}
+		size, err := strconv.ParseInt(pkg.Size, 0, 64)
+		if err != nil {
+			continue // malformed Size value
+		}
+		idx[src] = append(idx[src], index.Deb{
+			Package:      pkg.Package,
+			Version:      pkg.Version.String(),
+			Architecture: pkg.Architecture.String(),
+			URL:          target.RepoURI + pkg.Filename,
+			SHA256:       pkg.SHA256,
+			Size:         size,
+		})
+	}
+
+	return idx
+}
+
+// targetDebs is the result of genDebIndex for one Packages target.
+type targetDebs struct {
+	priority int64
+	debs     index.Debs
+}
+
+// genDebs writes the index file filename, which lists the .deb files of each
+// source package from the Packages targets indices, which genSources loaded:
+// either the regular or the debug targets, e.g. bookworm-debug, which contain
+// -dbgsym packages.
+func genDebs(filename string, indices []targetDebs) error {
+	// Packages targets exist per architecture, so the .deb files of a source
+	// package are merged across targets. Architecture: all packages are
+	// contained in the targets of all architectures.
+	sort.SliceStable(indices, func(i, j int) bool {
+		return indices[i].priority > indices[j].priority
+	})
+	merged := make(index.Debs)
+	type debKey struct {
+		src       index.Source
+		pkg, arch string
+	}
+	seen := make(map[debKey]bool)
+	for _, td := range indices {
+		for src, debs := range td.debs {
+			for _, deb := range debs {
+				key := debKey{src, deb.Package, deb.Architecture}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				merged[src] = append(merged[src], deb)
+			}
+		}
+	}
+	for _, debs := range merged {
+		sort.Slice(debs, func(i, j int) bool { // for a deterministic index file
+			if debs[i].Package != debs[j].Package {
+				return debs[i].Package < debs[j].Package
+			}
+			return debs[i].Architecture < debs[j].Architecture
+		})
+	}
+
+	if err := os.MkdirAll(*indexDir, 0755); err != nil {
+		return err
+	}
+
+	return write.Atomically(filepath.Join(*indexDir, filename), func(w io.Writer) error {
+		return merged.Encode(w)
+	})
+}
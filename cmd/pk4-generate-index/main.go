@@ -35,6 +35,8 @@ type indexTarget struct {
 	Filename  string
 	Codename  string
 	Release   string
+	Origin    string
+	Label     string
 	RepoURI   string `control:"Repo-URI"`
 	priority  int64
 }
@@ -59,10 +61,17 @@ func getIndexTargets() ([]indexTarget, error) {
 
 func main() {
 	flag.Parse()
-	if err := genSources(); err != nil {
+	debs, dbgsym, err := genSources()
+	if err != nil {
 		log.Fatal(err)
 	}
 	if err := genURIs(); err != nil {
 		log.Fatal(err)
 	}
+	if err := genDebs("debs.index", debs); err != nil {
+		log.Fatal(err)
+	}
+	if err := genDebs("dbgsym.index", dbgsym); err != nil {
+		log.Fatal(err)
+	}
 }
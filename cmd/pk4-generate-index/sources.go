@@ -35,28 +35,38 @@ func getBinaryIndexFile(filename string) ([]control.BinaryIndex, error) {
 	return index, cat.Wait()
 }
 
+// sourceOf returns the source package (and version) from which pkg was
+// built. ok is false if the Source field of pkg is malformed.
+func sourceOf(pkg control.BinaryIndex) (_ index.Source, ok bool) {
+	src := index.Source{
+		Package: pkg.Source,
+		Version: pkg.Version,
+	}
+	if src.Package == "" {
+		src.Package = pkg.Package
+	}
+	if strings.HasSuffix(src.Package, ")") {
+		idx := strings.Index(src.Package, " (")
+		if idx == -1 {
+			return src, false
+		}
+		var err error
+		src.Version, err = version.Parse(strings.TrimSuffix(src.Package[idx+2:], ")"))
+		if err != nil {
+			return src, false
+		}
+		src.Package = src.Package[:idx]
+	}
+	return src, true
+}
+
 func genIndex(bindex []control.BinaryIndex) index.Index {
 	pk4index := make(index.Index)
 
 	for _, pkg := range bindex {
-		src := index.Source{
-			Package: pkg.Source,
-			Version: pkg.Version,
-		}
-		if src.Package == "" {
-			src.Package = pkg.Package
-		}
-		if strings.HasSuffix(src.Package, ")") {
-			idx := strings.Index(src.Package, " (")
-			if idx == -1 {
-				continue // malformed Source value
-			}
-			var err error
-			src.Version, err = version.Parse(strings.TrimSuffix(src.Package[idx+2:], ")"))
-			if err != nil {
-				continue // malformed Source value
-			}
-			src.Package = src.Package[:idx]
+		src, ok := sourceOf(pkg)
+		if !ok {
+			continue // malformed Source value
 		}
 
 		for _, key := range []string{
@@ -74,15 +84,18 @@ func genIndex(bindex []control.BinaryIndex) index.Index {
 	return pk4index
 }
 
-func genSources() error {
+// genSources writes the sources and completion index files. Each Packages file
+// is only parsed once, so genSources also returns the .deb files listed in the
+// regular (debs) and debug (dbgsym) Packages targets, for genDebs.
+func genSources() (debs, dbgsym []targetDebs, _ error) {
 	defaultrel, err := getDefaultRelease()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	targets, err := getIndexTargets()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	for idx, target := range targets {
@@ -105,9 +118,10 @@ func genSources() error {
 	})
 
 	indices := make([]index.Index, len(targets))
+	debIndices := make([]index.Debs, len(targets))
 	var eg errgroup.Group
 	for idx, target := range targets {
-		if target.ShortDesc != "Packages" || strings.HasSuffix(target.Codename, "-debug") {
+		if target.ShortDesc != "Packages" {
 			continue
 		}
 
@@ -118,13 +132,31 @@ func genSources() error {
 				return err
 			}
 
-			indices[idx] = genIndex(index)
+			debIndices[idx] = genDebIndex(index, target)
+			if !strings.HasSuffix(target.Codename, "-debug") {
+				indices[idx] = genIndex(index)
+			}
 			return nil
 		})
 	}
 
 	if err := eg.Wait(); err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	for idx, target := range targets {
+		if debIndices[idx] == nil {
+			continue
+		}
+		td := targetDebs{
+			priority: target.priority,
+			debs:     debIndices[idx],
+		}
+		if strings.HasSuffix(target.Codename, "-debug") {
+			dbgsym = append(dbgsym, td)
+		} else {
+			debs = append(debs, td)
+		}
 	}
 
 	keys := make(map[string]struct{})
@@ -164,7 +196,7 @@ func genSources() error {
 	sort.Strings(sortedkeys)
 
 	if err := os.MkdirAll(*indexDir, 0755); err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	var weg errgroup.Group
@@ -211,7 +243,7 @@ func genSources() error {
 		})
 	})
 
-	return weg.Wait()
+	return debs, dbgsym, weg.Wait()
 
 	// TODO(later): apt-config parser
 	// TODO(later): look for pins within filepath.Join(Dir, Dir::Etc, Dir::Etc::PreferencesParts)
@@ -45,7 +45,7 @@ func getSourceIndexFile(filename string) ([]sourceIndex, error) {
 	return index, cat.Wait()
 }
 
-func genURIIndex(sindex []sourceIndex, repoURI string) index.URIs {
+func genURIIndex(sindex []sourceIndex, target indexTarget) index.URIs {
 	idx := make(index.URIs)
 
 	for _, pkg := range sindex {
@@ -63,14 +63,16 @@ func genURIIndex(sindex []sourceIndex, repoURI string) index.URIs {
 			if !strings.HasSuffix(f.Filename, ".dsc") {
 				continue
 			}
-			uri = repoURI + path.Join(pkg.Directory, f.Filename)
+			uri = target.RepoURI + path.Join(pkg.Directory, f.Filename)
 			break
 		}
 
 		if _, ok := idx[src]; !ok {
 			idx[src] = index.DSC{
-				URL:  uri,
-				Size: size,
+				URL:    uri,
+				Size:   size,
+				Origin: target.Origin,
+				Label:  target.Label,
 			}
 		}
 	}
@@ -111,7 +113,7 @@ func genURIs() error {
 				return err
 			}
 
-			indices[idx] = genURIIndex(index, target.RepoURI)
+			indices[idx] = genURIIndex(index, target)
 			return nil
 		})
 	}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"pault.ag/go/debian/version"
+)
+
+// buildPackage is the source package in the current directory which is about
+// to be built.
+type buildPackage struct {
+	source  string          // e.g. i3-wm
+	version version.Version // from debian/changelog
+	dir     string          // absolute path of the source tree
+	dist    string          // -dist, may be empty
+	start   time.Time       // when the build was started
+}
+
+// changesPattern returns a glob pattern matching the .changes files of pkg in
+// dir, e.g. dir/i3-wm_4.16-1_*.changes.
+func (pkg *buildPackage) changesPattern(dir string) string {
+	v := pkg.version.Version
+	if pkg.version.Revision != "" {
+		v += "-" + pkg.version.Revision
+	}
+	// file names never contain the epoch
+	return filepath.Join(dir, pkg.source+"_"+v+"_*.changes")
+}
+
+// newestChanges returns the path of the most recently modified binary
+// .changes file of pkg in dir which was written during the build.
+func newestChanges(pkg *buildPackage, dir string) (string, error) {
+	matches, err := filepath.Glob(pkg.changesPattern(dir))
+	if err != nil {
+		return "", err
+	}
+	type candidate struct {
+		path    string
+		modTime time.Time
+	}
+	var candidates []candidate
+	for _, m := range matches {
+		if strings.HasSuffix(m, "_source.changes") {
+			continue // e.g. pdebuild also builds a source package
+		}
+		fi, err := os.Stat(m)
+		if err != nil {
+			return "", err
+		}
+		// mtime granularity might be as coarse as one second
+		if fi.ModTime().Before(pkg.start.Truncate(time.Second)) {
+			continue // left over from a previous build
+		}
+		candidates = append(candidates, candidate{m, fi.ModTime()})
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("build succeeded, but no .changes file matching %s was written", pkg.changesPattern(dir))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime.After(candidates[j].modTime)
+	})
+	return candidates[0].path, nil
+}
+
+// Builder builds the binary packages of a source package.
+type Builder interface {
+	// Command returns the command which builds pkg.
+	Command(pkg *buildPackage) *exec.Cmd
+
+	// Run runs cmd (as returned by Command) and returns the path of the
+	// resulting .changes file.
+	Run(pkg *buildPackage, cmd *exec.Cmd) (changesFile string, _ error)
+}
+
+// defaultSbuildCommand makes sbuild write the path of the .changes file to
+// file descriptor 3 once the build is done.
+var defaultSbuildCommand = []string{
+	"sbuild",
+	"--post-build-commands",
+	"echo %SBUILD_CHANGES > /proc/self/fd/3",
+	"-A",
+	"--no-clean-source",
+	"--dpkg-source-opt=--auto-commit",
+}
+
+// sbuildBuilder runs sbuild (or any other Build-Command which writes the path
+// of the resulting .changes file to file descriptor 3).
+type sbuildBuilder struct {
+	command []string
+}
+
+func (b *sbuildBuilder) Command(pkg *buildPackage) *exec.Cmd {
+	sbuild := exec.Command(b.command[0], b.command[1:]...)
+	if pkg.dist != "" {
+		sbuild.Args = append(sbuild.Args, "-d", pkg.dist)
+	}
+	return sbuild
+}
+
+func (b *sbuildBuilder) Run(pkg *buildPackage, sbuild *exec.Cmd) (string, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer pr.Close()
+	sbuild.ExtraFiles = []*os.File{pw} // populates fd 3
+	if err := sbuild.Run(); err != nil {
+		pw.Close()
+		return "", err
+	}
+	if err := pw.Close(); err != nil {
+		return "", err
+	}
+	// NOTE: we can only do the read this late because we assume the pipe never
+	// fills its buffer. Given that we are just printing a file path to it,
+	// filling the buffer seems very unlikely.
+	out, err := ioutil.ReadAll(pr)
+	if err != nil {
+		return "", err
+	}
+	changesFile := strings.TrimSpace(string(out))
+	if changesFile == "" {
+		return "", fmt.Errorf("%v did not write the path of the .changes file to fd 3", sbuild.Args)
+	}
+	return changesFile, nil
+}
+
+// dpkgBuilder builds in the current system using dpkg-buildpackage, i.e. the
+// build dependencies must be installed.
+type dpkgBuilder struct{}
+
+func (b *dpkgBuilder) Command(pkg *buildPackage) *exec.Cmd {
+	if pkg.dist != "" {
+		log.Printf("warning: ignoring -dist %q: dpkg-buildpackage builds for the host system", pkg.dist)
+	}
+	// -b: binary-only, -uc -us: do not sign
+	return exec.Command("dpkg-buildpackage", "-b", "-uc", "-us")
+}
+
+func (b *dpkgBuilder) Run(pkg *buildPackage, cmd *exec.Cmd) (string, error) {
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	// dpkg-buildpackage places its results in the parent directory.
+	return newestChanges(pkg, filepath.Dir(pkg.dir))
+}
+
+// pbuilderBuilder builds in a pbuilder (or cowbuilder) chroot using pdebuild.
+type pbuilderBuilder struct {
+	cowbuilder bool
+}
+
+func (b *pbuilderBuilder) Command(pkg *buildPackage) *exec.Cmd {
+	pdebuild := exec.Command("pdebuild", "--buildresult", filepath.Dir(pkg.dir))
+	if b.cowbuilder {
+		pdebuild.Args = append(pdebuild.Args, "--pbuilder", "cowbuilder")
+	}
+	if pkg.dist != "" {
+		// Honored by the usual ~/.pbuilderrc recipes for multiple distributions,
+		// see https://wiki.debian.org/PbuilderTricks
+		pdebuild.Env = append(os.Environ(), "DIST="+pkg.dist)
+	}
+	return pdebuild
+}
+
+func (b *pbuilderBuilder) Run(pkg *buildPackage, cmd *exec.Cmd) (string, error) {
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return newestChanges(pkg, filepath.Dir(pkg.dir))
+}
+
+// containerBuilder builds in a throw-away container using podman or docker,
+// which is only given access to the parent directory of the source tree.
+type containerBuilder struct {
+	runtime string // podman or docker
+	image   string // e.g. debian:sid, default: debian:<-dist>
+}
+
+func (b *containerBuilder) Command(pkg *buildPackage) *exec.Cmd {
+	image := b.image
+	if image == "" {
+		dist := pkg.dist
+		if dist == "" {
+			dist = "unstable"
+		}
+		image = "debian:" + dist
+	}
+	parent := filepath.Dir(pkg.dir)
+	work := "/build/" + filepath.Base(pkg.dir)
+	script := strings.Join([]string{
+		"apt-get update",
+		"apt-get install -y --no-install-recommends build-essential",
+		"apt-get build-dep -y ./",
+		"dpkg-buildpackage -b -uc -us",
+	}, " && ")
+	if b.runtime == "docker" {
+		// Files created within the container belong to root, so hand them back
+		// to the user, also when the build fails. podman (rootless) maps root
+		// to the user already.
+		owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+		script = "trap 'chown -R " + owner + " . ../" + pkg.source + "_*' EXIT; " + script
+	}
+	return exec.Command(b.runtime,
+		"run",
+		"--rm",
+		"--volume", parent+":/build",
+		"--workdir", work,
+		image,
+		"sh", "-c", script)
+}
+
+func (b *containerBuilder) Run(pkg *buildPackage, cmd *exec.Cmd) (string, error) {
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return newestChanges(pkg, filepath.Dir(pkg.dir))
+}
+
+// builders lists the names which can be used with -builder, see newBuilder.
+var builders = []string{
+	"sbuild",
+	"dpkg-buildpackage",
+	"pbuilder",
+	"cowbuilder",
+	"podman",
+	"docker",
+}
+
+// newBuilder returns the Builder called name. buildCommand (Build-Command)
+// applies to sbuild only, image (Container-Image) to podman and docker only.
+func newBuilder(name string, buildCommand []string, image string) (Builder, error) {
+	switch name {
+	case "sbuild":
+		if len(buildCommand) == 0 {
+			buildCommand = defaultSbuildCommand
+		}
+		return &sbuildBuilder{command: buildCommand}, nil
+	case "dpkg-buildpackage":
+		return &dpkgBuilder{}, nil
+	case "pbuilder":
+		return &pbuilderBuilder{}, nil
+	case "cowbuilder":
+		return &pbuilderBuilder{cowbuilder: true}, nil
+	case "podman", "docker":
+		return &containerBuilder{runtime: name, image: image}, nil
+	}
+	return nil, fmt.Errorf("unknown builder %q, expected one of %s", name, strings.Join(builders, ", "))
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"pault.ag/go/debian/version"
+)
+
+func mustParseVersion(v string) version.Version {
+	ver, err := version.Parse(v)
+	if err != nil {
+		panic(err)
+	}
+	return ver
+}
+
+func TestNewestChanges(t *testing.T) {
+	t.Parallel()
+
+	// The build starts within a second, which file system timestamps might
+	// not resolve:
+	start := time.Now().Truncate(time.Second).Add(500 * time.Millisecond)
+	stale := start.Add(-1 * time.Hour)
+	for _, entry := range []struct {
+		name    string
+		version string
+		files   map[string]time.Time // file name to modification time
+		want    string               // empty if an error is expected
+	}{
+		{
+			name:    "Binary",
+			version: "2.10-1",
+			files: map[string]time.Time{
+				"hello_2.10-1_amd64.changes": start,
+			},
+			want: "hello_2.10-1_amd64.changes",
+		},
+
+		{
+			name:    "SubsecondStart",
+			version: "2.10-1",
+			files: map[string]time.Time{
+				"hello_2.10-1_amd64.changes": start.Truncate(time.Second),
+			},
+			want: "hello_2.10-1_amd64.changes",
+		},
+
+		{
+			name:    "Stale",
+			version: "2.10-1",
+			files: map[string]time.Time{
+				"hello_2.10-1_amd64.changes": stale,
+			},
+		},
+
+		{
+			name:    "StaleAndNew",
+			version: "2.10-1",
+			files: map[string]time.Time{
+				"hello_2.10-1_i386.changes":  stale,
+				"hello_2.10-1_amd64.changes": start.Add(1 * time.Minute),
+			},
+			want: "hello_2.10-1_amd64.changes",
+		},
+
+		{
+			name:    "SourceChanges",
+			version: "2.10-1",
+			files: map[string]time.Time{
+				"hello_2.10-1_amd64.changes":  start.Add(1 * time.Minute),
+				"hello_2.10-1_source.changes": start.Add(2 * time.Minute),
+			},
+			want: "hello_2.10-1_amd64.changes",
+		},
+
+		{
+			name:    "Epoch",
+			version: "1:2.10-1",
+			files: map[string]time.Time{
+				"hello_2.10-1_amd64.changes": start,
+			},
+			want: "hello_2.10-1_amd64.changes",
+		},
+
+		{
+			name:    "Native",
+			version: "2.10",
+			files: map[string]time.Time{
+				"hello_2.10_amd64.changes":   start,
+				"hello_2.10-1_amd64.changes": start, // other version
+			},
+			want: "hello_2.10_amd64.changes",
+		},
+
+		{
+			name:    "OtherVersion",
+			version: "2.10-2",
+			files: map[string]time.Time{
+				"hello_2.10-1_amd64.changes": start,
+			},
+		},
+	} {
+		entry := entry // copy
+		t.Run(entry.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "pk4-replace-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, modTime := range entry.files {
+				path := filepath.Join(dir, name)
+				if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pkg := &buildPackage{
+				source:  "hello",
+				version: mustParseVersion(entry.version),
+				dir:     filepath.Join(dir, "hello-2.10"),
+				start:   start,
+			}
+			got, err := newestChanges(pkg, dir)
+			if entry.want == "" {
+				if err == nil {
+					t.Fatalf("newestChanges unexpectedly succeeded: %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, entry.want); got != want {
+				t.Fatalf("newestChanges: got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestBuilderCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, entry := range []struct {
+		builder  string
+		image    string // Container-Image
+		dist     string
+		wantArgs []string
+		wantEnv  string // must be contained in Env, if non-empty
+	}{
+		{
+			builder:  "sbuild",
+			dist:     "sid",
+			wantArgs: append(append([]string{}, defaultSbuildCommand...), "-d", "sid"),
+		},
+
+		{
+			builder:  "dpkg-buildpackage",
+			wantArgs: []string{"dpkg-buildpackage", "-b", "-uc", "-us"},
+		},
+
+		{
+			builder:  "pbuilder",
+			wantArgs: []string{"pdebuild", "--buildresult", "/src"},
+		},
+
+		{
+			builder:  "pbuilder",
+			dist:     "sid",
+			wantArgs: []string{"pdebuild", "--buildresult", "/src"},
+			wantEnv:  "DIST=sid",
+		},
+
+		{
+			builder:  "cowbuilder",
+			wantArgs: []string{"pdebuild", "--buildresult", "/src", "--pbuilder", "cowbuilder"},
+		},
+
+		{
+			builder:  "cowbuilder",
+			dist:     "bookworm",
+			wantArgs: []string{"pdebuild", "--buildresult", "/src", "--pbuilder", "cowbuilder"},
+			wantEnv:  "DIST=bookworm",
+		},
+
+		{
+			builder: "podman",
+			wantArgs: []string{"podman", "run", "--rm",
+				"--volume", "/src:/build",
+				"--workdir", "/build/hello-2.10",
+				"debian:unstable"},
+		},
+
+		{
+			builder: "podman",
+			dist:    "bookworm",
+			wantArgs: []string{"podman", "run", "--rm",
+				"--volume", "/src:/build",
+				"--workdir", "/build/hello-2.10",
+				"debian:bookworm"},
+		},
+
+		{
+			builder: "docker",
+			image:   "registry.example.net/debian-dev:sid",
+			dist:    "bookworm",
+			wantArgs: []string{"docker", "run", "--rm",
+				"--volume", "/src:/build",
+				"--workdir", "/build/hello-2.10",
+				"registry.example.net/debian-dev:sid"},
+		},
+	} {
+		b, err := newBuilder(entry.builder, nil, entry.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkg := &buildPackage{
+			source:  "hello",
+			version: mustParseVersion("2.10-1"),
+			dir:     "/src/hello-2.10",
+			dist:    entry.dist,
+		}
+		cmd := b.Command(pkg)
+		args := cmd.Args
+		if _, ok := b.(*containerBuilder); ok {
+			// The build script is verified below.
+			if got, want := args[len(args)-3:len(args)-1], []string{"sh", "-c"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s (dist %q): unexpected script invocation: got %q, want %q", entry.builder, entry.dist, got, want)
+			}
+			script := args[len(args)-1]
+			if !strings.Contains(script, "dpkg-buildpackage -b") {
+				t.Errorf("%s: build script %q does not call dpkg-buildpackage", entry.builder, script)
+			}
+			if got, want := strings.Contains(script, "chown"), entry.builder == "docker"; got != want {
+				t.Errorf("%s: build script %q: chown = %v, want %v", entry.builder, script, got, want)
+			}
+			args = args[:len(args)-3]
+		}
+		if !reflect.DeepEqual(args, entry.wantArgs) {
+			t.Errorf("%s (dist %q): got args %q, want %q", entry.builder, entry.dist, args, entry.wantArgs)
+		}
+		if entry.wantEnv == "" {
+			if cmd.Env != nil {
+				t.Errorf("%s (dist %q): unexpected env %q", entry.builder, entry.dist, cmd.Env)
+			}
+			continue
+		}
+		found := false
+		for _, kv := range cmd.Env {
+			if kv == entry.wantEnv {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s (dist %q): %s not in env", entry.builder, entry.dist, entry.wantEnv)
+		}
+	}
+
+	if _, err := newBuilder("make", nil, ""); err == nil {
+		t.Errorf("newBuilder(make) unexpectedly succeeded")
+	}
+}
+
+func TestBuilderRun(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pk4-replace-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pkg := &buildPackage{
+		source:  "hello",
+		version: mustParseVersion("2.10-1"),
+		dir:     filepath.Join(dir, "hello-2.10"),
+		start:   time.Now(),
+	}
+	if err := os.MkdirAll(pkg.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Sbuild", func(t *testing.T) {
+		// Like sbuild --post-build-commands:
+		b := &sbuildBuilder{command: []string{"sh", "-c", "echo /srv/hello_2.10-1_amd64.changes >&3"}}
+		got, err := b.Run(pkg, b.Command(pkg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "/srv/hello_2.10-1_amd64.changes"; got != want {
+			t.Fatalf("sbuild: got %q, want %q", got, want)
+		}
+
+		b = &sbuildBuilder{command: []string{"true"}}
+		if _, err := b.Run(pkg, b.Command(pkg)); err == nil {
+			t.Fatalf("sbuild unexpectedly succeeded without writing to fd 3")
+		}
+	})
+
+	t.Run("DpkgBuildpackage", func(t *testing.T) {
+		// Like dpkg-buildpackage, which writes to the parent directory:
+		cmd := exec.Command("sh", "-c", "touch ../hello_2.10-1_amd64.changes")
+		cmd.Dir = pkg.dir
+		got, err := (&dpkgBuilder{}).Run(pkg, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(dir, "hello_2.10-1_amd64.changes"); got != want {
+			t.Fatalf("dpkg-buildpackage: got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestContainerChownOnFailure(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Fake the commands within the container: the build fails, chown records
+	// that it was called.
+	bin := filepath.Join(tmp, "bin")
+	chowned := filepath.Join(tmp, "chowned")
+	dir := filepath.Join(tmp, "hello-2.10")
+	for _, d := range []string{bin, dir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, script := range map[string]string{
+		"apt-get":           "exit 0",
+		"dpkg-buildpackage": "exit 2",
+		"chown":             "echo \"$@\" > " + chowned,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := newBuilder("docker", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := b.Command(&buildPackage{
+		source:  "hello",
+		version: mustParseVersion("2.10-1"),
+		dir:     dir,
+	}).Args
+	sh := exec.Command("/bin/sh", "-c", args[len(args)-1])
+	sh.Dir = dir
+	sh.Env = []string{"PATH=" + bin}
+	err = sh.Run()
+	if exiterr, ok := err.(*exec.ExitError); !ok || exiterr.ExitCode() != 2 {
+		t.Errorf("build script: got err %v, want exit status 2 of the failed build", err)
+	}
+	if _, err := os.Stat(chowned); err != nil {
+		t.Errorf("chown not run after the failed build: %v", err)
+	}
+}
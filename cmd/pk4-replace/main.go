@@ -1,6 +1,6 @@
-// Program pk4-replace builds the sources in the current directory using sbuild,
-// then replaces the subset of currently installed binary packages with the
-// newly built packages.
+// Program pk4-replace builds the sources in the current directory (using sbuild
+// by default, see Builder), then replaces the subset of currently installed
+// binary packages with the newly built packages.
 package main
 
 import (
@@ -16,6 +16,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Debian/pk4/internal/hooks"
+
 	"pault.ag/go/debian/changelog"
 	"pault.ag/go/debian/control"
 )
@@ -25,59 +27,59 @@ import (
 var errDryRun = errors.New("dry run requested")
 
 type invocation struct {
-	configDir    string
-	buildCommand []string
-	dist         string
+	configDir      string
+	builderName    string
+	buildCommand   []string
+	containerImage string
+	dist           string
+	hookTimeout    time.Duration
 
 	dryRun bool
 }
 
 func (i *invocation) build() (changesFile string, _ error) {
-	pr, pw, err := os.Pipe()
+	builder, err := newBuilder(i.builderName, i.buildCommand, i.containerImage)
+	if err != nil {
+		return "", err
+	}
+	latest, err := changelog.ParseFileOne("debian/changelog")
 	if err != nil {
 		return "", err
 	}
-	sbuild := exec.Command(i.buildCommand[0], i.buildCommand[1:]...)
-	if i.dist != "" {
-		sbuild.Args = append(sbuild.Args, "-d", i.dist)
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	pkg := &buildPackage{
+		source:  latest.Source,
+		version: latest.Version,
+		dir:     wd,
+		dist:    i.dist,
 	}
-	log.Printf("Building package using %q", sbuild.Args)
+	cmd := builder.Command(pkg)
+	log.Printf("Building package using %q", cmd.Args)
 	if i.dryRun {
 		return "", errDryRun
 	}
-	ts := time.Now().UTC().Format("2006-01-02T15:04:05Z") // like sbuild
+	pkg.start = time.Now()
+	ts := pkg.start.UTC().Format("2006-01-02T15:04:05Z") // like sbuild
 
-	latest, err := changelog.ParseFileOne("debian/changelog")
-	if err != nil {
-		return "", err
-	}
 	prefix := fmt.Sprintf("%s_%s", latest.Source, latest.Version)
 	stderr, err := os.Create("../" + prefix + "-" + ts + ".stderr")
 	if err != nil {
 		return "", err
 	}
 	defer stderr.Close()
-	sbuild.Stderr = stderr
+	cmd.Stderr = stderr
 
 	stdout, err := os.Create("../" + prefix + "-" + ts + ".stdout")
 	if err != nil {
 		return "", err
 	}
 	defer stdout.Close()
-	sbuild.Stdout = stdout
+	cmd.Stdout = stdout
 
-	sbuild.ExtraFiles = []*os.File{pw} // populates fd 3
-	if err := sbuild.Run(); err != nil {
-		return "", err
-	}
-	if err := pw.Close(); err != nil {
-		return "", err
-	}
-	// NOTE: we can only do the read this late because we assume the pipe never
-	// fills its buffer. Given that we are just printing a file path to it,
-	// filling the buffer seems very unlikely.
-	b, err := ioutil.ReadAll(pr)
-	return strings.TrimSpace(string(b)), err
+	return builder.Run(pkg, cmd)
 }
 
 // packagesToReplace finds out which binary packages of the just-built binary
@@ -140,11 +142,42 @@ func (i *invocation) logic() error {
 	for i, pkg := range pkgs {
 		args[i] = filepath.Join(dir, pkg)
 	}
+
+	latest, err := changelog.ParseFileOne("debian/changelog")
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	env := hooks.Env{
+		Source:    latest.Source,
+		Version:   latest.Version.String(),
+		OutputDir: wd,
+		Changes:   changesFile,
+	}
+	r := hooks.Runner{
+		Dir:     filepath.Join(i.configDir, "hooks-enabled"),
+		Timeout: i.hookTimeout,
+	}
+	if _, err := r.Run(hooks.BeforeReplace, wd, env, args...); err != nil {
+		return err
+	}
+
 	install := exec.Command("sudo", append([]string{"dpkg", "-i"}, args...)...)
 	log.Printf("Installing replacement packages using %q", install.Args)
 	install.Stdout = os.Stdout
 	install.Stderr = os.Stderr
-	return install.Run()
+	if err := install.Run(); err != nil {
+		return err
+	}
+
+	if _, err := r.Run(hooks.AfterReplace, wd, env, args...); err != nil {
+		log.Printf("hook failure: %v", err)
+		// hooks are best-effort, don’t fail
+	}
+	return nil
 }
 
 func (i *invocation) readConfig(configPath string) error {
@@ -156,19 +189,35 @@ func (i *invocation) readConfig(configPath string) error {
 		return err
 	}
 	var config struct {
-		BuildCommand []string `control:"Build-Command" delim:"\n" strip:"\n\r\t "`
-		Dist         string   `control:"Dist"`
+		Builder        string   `control:"Builder"`
+		BuildCommand   []string `control:"Build-Command" delim:"\n" strip:"\n\r\t "`
+		ContainerImage string   `control:"Container-Image"`
+		Dist           string   `control:"Dist"`
+		HookTimeout    string   `control:"Hook-Timeout"`
 	}
 	if err := control.Unmarshal(&config, bytes.NewReader(b)); err != nil {
 		return err
 	}
 	log.Printf("read config from %s: %+v", configPath, config)
+	if config.Builder != "" {
+		i.builderName = config.Builder
+	}
 	if len(config.BuildCommand) > 0 {
 		i.buildCommand = config.BuildCommand
 	}
+	if config.ContainerImage != "" {
+		i.containerImage = config.ContainerImage
+	}
 	if config.Dist != "" {
 		i.dist = config.Dist
 	}
+	if config.HookTimeout != "" {
+		if v, err := time.ParseDuration(config.HookTimeout); err != nil {
+			log.Printf("invalid Hook-Timeout value %q in config file %s: %v", config.HookTimeout, configPath, err)
+		} else {
+			i.hookTimeout = v
+		}
+	}
 	return nil
 }
 
@@ -187,23 +236,20 @@ func resolveTilde(s string) string {
 
 func main() {
 	i := invocation{
-		buildCommand: []string{
-			"sbuild",
-			"--post-build-commands",
-			"echo %SBUILD_CHANGES > /proc/self/fd/3",
-			"-A",
-			"--no-clean-source",
-			"--dpkg-source-opt=--auto-commit",
-		},
+		hookTimeout: hooks.DefaultTimeout,
 	}
 
 	flag.BoolVar(&i.dryRun, "dry_run",
 		false,
 		"Print the build command and exit")
 
+	flag.StringVar(&i.builderName, "builder",
+		"sbuild",
+		"How to build the package, one of "+strings.Join(builders, ", "))
+
 	flag.StringVar(&i.dist, "dist",
 		"",
-		"Distribution for the package build. If non-empty, will be passed to sbuild -d")
+		"Distribution for the package build. If non-empty, will be passed to sbuild -d, to pbuilder/cowbuilder as $DIST or used as debian:<dist> container image")
 
 	i.configDir = resolveTilde("~/.config/pk4")
 	configPath := filepath.Join(i.configDir, "pk4.deb822")
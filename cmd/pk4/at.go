@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Debian/pk4/internal/snapshot"
+	"pault.ag/go/debian/version"
+)
+
+// components are the archive components searched for -at, in order.
+var components = []string{"main", "contrib", "non-free", "non-free-firmware"}
+
+// parseAt parses the value of the -at flag.
+func parseAt(s string) (time.Time, error) {
+	for _, layout := range []string{
+		"2006-01-02",
+		time.RFC3339,
+		"20060102T150405Z", // as used by snapshot.debian.org
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid -at value %q: expected e.g. 2024-03-01, 2024-03-01T12:00:00Z or 20240301T120000Z", s)
+}
+
+// sourceAt is a source package entry of a Sources index.
+type sourceAt struct {
+	pkg      string
+	version  version.Version
+	binaries []string
+}
+
+// scanSources calls fn for each paragraph of the Sources index r. Only the
+// Package, Version and Binary fields are parsed, which is much faster than
+// using control.Unmarshal on the entire index.
+func scanSources(r io.Reader, fn func(sourceAt)) error {
+	var (
+		cur     sourceAt
+		field   string
+		binary  string
+		scanner = bufio.NewScanner(r)
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	flush := func() {
+		if cur.pkg != "" {
+			for _, bin := range strings.Split(binary, ",") {
+				if bin = strings.TrimSpace(bin); bin != "" {
+					cur.binaries = append(cur.binaries, bin)
+				}
+			}
+			fn(cur)
+		}
+		cur = sourceAt{}
+		binary = ""
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if field == "Binary" {
+				binary += line // continuation line
+			}
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx == -1 {
+			continue
+		}
+		field = line[:idx]
+		value := strings.TrimSpace(line[idx+1:])
+		switch field {
+		case "Package":
+			cur.pkg = value
+		case "Version":
+			v, err := version.Parse(value)
+			if err != nil {
+				return fmt.Errorf("package %s: %v", cur.pkg, err)
+			}
+			cur.version = v
+		case "Binary":
+			binary = value
+		}
+	}
+	flush()
+	return scanner.Err()
+}
+
+// resolveAt resolves i.arg to the source package version which was current in
+// i.suite at the point in time i.at, as recorded by snapshot.debian.org.
+func (i *invocation) resolveAt() (srcpkg string, srcversion string, _ error) {
+	if i.version != "" {
+		return "", "", fmt.Errorf("at most one of -at or -version must be specified, not both")
+	}
+	if i.offline {
+		return "", "", fmt.Errorf("-at requires snapshot.debian.org, but -offline forbids network access")
+	}
+	at, err := parseAt(i.at)
+	if err != nil {
+		return "", "", err
+	}
+	timestamp := at.UTC().Format("20060102T150405Z")
+
+	binpkg := i.arg
+	if idx := strings.Index(binpkg, ":"); idx > -1 {
+		binpkg = binpkg[:idx] // strip e.g. :amd64 suffix
+	}
+
+	client := i.snapshotClient()
+	for _, archive := range i.snapshotArchives {
+		for _, component := range components {
+			rc, err := client.Sources(archive.name, timestamp, i.suite, component)
+			if err != nil {
+				if err == snapshot.ErrNotFound {
+					continue // suite or component not in this archive
+				}
+				return "", "", err
+			}
+			var bySource, byBinary *sourceAt
+			err = scanSources(rc, func(src sourceAt) {
+				if !i.bin && src.pkg == i.arg {
+					if bySource == nil || version.Compare(src.version, bySource.version) > 0 {
+						bySource = &src
+					}
+				}
+				if i.src {
+					return
+				}
+				for _, bin := range src.binaries {
+					if bin != binpkg {
+						continue
+					}
+					if byBinary == nil || version.Compare(src.version, byBinary.version) > 0 {
+						byBinary = &src
+					}
+				}
+			})
+			rc.Close()
+			if err != nil {
+				return "", "", err
+			}
+			found := bySource
+			if found == nil {
+				found = byBinary
+			}
+			if found == nil {
+				continue
+			}
+			i.V().Printf("%s resolved to source package %s %s (in %s %s/%s at %s)", i.arg, found.pkg, found.version, archive.name, i.suite, component, timestamp)
+			return found.pkg, found.version.String(), nil
+		}
+	}
+	return "", "", fmt.Errorf("%q not found in suite %q at %s on snapshot.debian.org", i.arg, i.suite, timestamp)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+const testingSources = `Package: hello
+Binary: hello
+Version: 2.10-2
+Directory: pool/main/h/hello
+
+Package: hello
+Binary: hello
+Version: 2.10-3
+Directory: pool/main/h/hello
+
+Package: xorg-server
+Binary: xserver-xorg-core, xserver-xorg-dev,
+ xserver-xephyr, xvfb
+Version: 2:21.1.11-2
+Directory: pool/main/x/xorg-server
+`
+
+func TestResolveAt(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/archive/debian/20240301T000000Z/dists/testing/main/source/Sources.gz", func(w http.ResponseWriter, r *http.Request) {
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(testingSources))
+		gz.Close()
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, entry := range []struct {
+		name           string
+		arg            string
+		src            bool
+		wantSrcpkg     string
+		wantSrcversion string
+	}{
+		{
+			name:           "SourcePackage",
+			arg:            "hello",
+			src:            true,
+			wantSrcpkg:     "hello",
+			wantSrcversion: "2.10-3",
+		},
+
+		{
+			name:           "BinaryPackageContinuationLine",
+			arg:            "xserver-xephyr:amd64",
+			wantSrcpkg:     "xorg-server",
+			wantSrcversion: "2:21.1.11-2",
+		},
+	} {
+		entry := entry // copy
+		t.Run(entry.name, func(t *testing.T) {
+			dest, err := ioutil.TempDir("", "pk4test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dest)
+
+			i := invocation{
+				verbose:          *verbose,
+				dest:             dest,
+				arg:              entry.arg,
+				src:              entry.src,
+				at:               "2024-03-01",
+				suite:            "testing",
+				snapshotBase:     ts.URL + "/",
+				snapshotArchives: []snapshotArchive{{name: "debian"}},
+			}
+			srcpkg, srcversion, err := i.resolve()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := srcpkg, entry.wantSrcpkg; got != want {
+				t.Fatalf("unexpected srcpkg: got %q, want %q", got, want)
+			}
+			if got, want := srcversion, entry.wantSrcversion; got != want {
+				t.Fatalf("unexpected srcversion: got %q, want %q", got, want)
+			}
+		})
+	}
+}
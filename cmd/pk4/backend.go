@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// A backend knows where to find the files of a source package when the mirror
+// from which pk4 tried to download them no longer carries them, e.g. because
+// the package version was superseded. Each archive (as identified by the Origin
+// and Label fields of its Release file) has its own strategy.
+type backend interface {
+	// fallback returns the URI from which uri can be downloaded instead, or
+	// the empty string if there is no fallback.
+	fallback(uri string) string
+}
+
+// noFallback is used for archives about which pk4 knows nothing.
+type noFallback struct{}
+
+func (noFallback) fallback(uri string) string { return "" }
+
+// poolPath returns the path of uri relative to the archive root, e.g.
+// pool/main/h/hello/hello_2.10-1.dsc. All Debian-style archives store their
+// files underneath pool/.
+func poolPath(uri string) string {
+	if idx := strings.Index(uri, "/pool/"); idx > -1 {
+		return uri[idx+1:]
+	}
+	return ""
+}
+
+// rebase returns the file of uri underneath the archive root base.
+func rebase(base, uri string) string {
+	rel := poolPath(uri)
+	if rel == "" {
+		return ""
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	u.Path = path.Join(u.Path, rel)
+	return u.String()
+}
+
+// snapshotBackend falls back to snapshot.debian.org, which has every file that
+// was ever part of the Debian archive.
+type snapshotBackend struct {
+	// snapshotBase is the URL of the archive root at a point in time at which
+	// the source package was part of the archive, e.g.
+	// http://snapshot.debian.org/archive/debian/20150322T153011Z
+	snapshotBase string
+}
+
+func (b snapshotBackend) fallback(uri string) string {
+	return rebase(b.snapshotBase, uri)
+}
+
+// snapshotArchive is an archive on snapshot.debian.org (e.g. debian-security)
+// in which pk4 looks for source packages which are not in the index.
+type snapshotArchive struct {
+	name   string
+	mirror string // URL of the archive root on a regular mirror, if any
+}
+
+// defaultSnapshotArchives is the order in which snapshot.debian.org archives
+// are considered unless configured otherwise via Snapshot-Archives.
+var defaultSnapshotArchives = []snapshotArchive{
+	{name: "debian"},
+	{name: "debian-security"},
+	{name: "debian-backports"},
+	{name: "debian-ports"},
+}
+
+// archiveMirrors maps snapshot.debian.org archive names to the URL of the
+// corresponding archive on a regular mirror. The “debian” archive uses
+// invocation.mirrorUrl.
+var archiveMirrors = map[string]string{
+	"debian-security":  "https://deb.debian.org/debian-security",
+	"debian-ports":     "https://deb.debian.org/debian-ports",
+	"debian-backports": "http://archive.debian.org/debian-backports",
+}
+
+// parseSnapshotArchives parses the value of the Snapshot-Archives config
+// option: one archive per line, optionally followed by the URL of a mirror.
+func parseSnapshotArchives(lines []string) ([]snapshotArchive, error) {
+	archives := make([]snapshotArchive, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			archives = append(archives, snapshotArchive{name: fields[0]})
+		case 2:
+			archives = append(archives, snapshotArchive{name: fields[0], mirror: fields[1]})
+		default:
+			return nil, fmt.Errorf("invalid line %q: expected <archive> [<mirror URL>]", line)
+		}
+	}
+	return archives, nil
+}
+
+// archiveMirror returns the URL of a regular mirror for archive, or the empty
+// string if files of archive should be downloaded from snapshot.debian.org.
+func (i *invocation) archiveMirror(archive snapshotArchive) string {
+	if archive.mirror != "" {
+		return archive.mirror
+	}
+	if archive.name == "debian" {
+		return i.mirrorUrl
+	}
+	return archiveMirrors[archive.name]
+}
+
+// launchpadBackend falls back to Launchpad, which keeps all source packages
+// ever uploaded to Ubuntu.
+type launchpadBackend struct {
+	base       string // e.g. https://launchpad.net/
+	srcpkg     string
+	srcversion string
+}
+
+func (b launchpadBackend) fallback(uri string) string {
+	u, err := url.Parse(b.base)
+	if err != nil {
+		return ""
+	}
+	u.Path = path.Join(u.Path, "ubuntu", "+archive", "primary", "+sourcefiles", b.srcpkg, b.srcversion, path.Base(uri))
+	return u.String()
+}
+
+// mirrorBackend falls back to a user-configured archive with the same pool/
+// layout, e.g. a local aptly snapshot.
+type mirrorBackend struct {
+	fallbackURI string
+}
+
+func (b mirrorBackend) fallback(uri string) string {
+	return rebase(b.fallbackURI, uri)
+}
+
+// origin is a user-configured archive, read from
+// ~/.config/pk4/origins.deb822.
+type origin struct {
+	Origin      string
+	Label       string
+	FallbackURI string `control:"Fallback-URI"`
+}
+
+func (o origin) matches(originName, label string) bool {
+	if o.Origin != originName {
+		return false
+	}
+	return o.Label == "" || o.Label == label
+}
+
+func (i *invocation) readOrigins(originsPath string) error {
+	b, err := ioutil.ReadFile(originsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var origins []origin
+	if err := control.Unmarshal(&origins, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	i.V().Printf("read origins from %s: %+v", originsPath, origins)
+	i.origins = origins
+	return nil
+}
+
+// backendFor returns the backend to use for downloading srcpkg in srcversion
+// from the archive identified by originName and label.
+func (i *invocation) backendFor(originName, label, srcpkg, srcversion string) backend {
+	for _, o := range i.origins {
+		if o.matches(originName, label) {
+			return mirrorBackend{fallbackURI: o.FallbackURI}
+		}
+	}
+	switch originName {
+	case "Ubuntu":
+		return launchpadBackend{
+			base:       i.launchpadBase,
+			srcpkg:     srcpkg,
+			srcversion: srcversion,
+		}
+	}
+	return noFallback{}
+}
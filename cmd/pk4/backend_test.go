@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestBackendFallback(t *testing.T) {
+	t.Parallel()
+
+	i := invocation{
+		verbose:       *verbose,
+		launchpadBase: "https://launchpad.example/",
+		origins: []origin{
+			{
+				Origin:      "Example",
+				Label:       "internal",
+				FallbackURI: "http://aptly.example/snapshots/2020",
+			},
+		},
+	}
+
+	for _, entry := range []struct {
+		name   string
+		origin string
+		label  string
+		uri    string
+		want   string
+	}{
+		{
+			name:   "Debian",
+			origin: "Debian",
+			label:  "Debian",
+			uri:    "https://deb.debian.org/debian/pool/main/h/hello/hello_2.10-1.dsc",
+			want:   "",
+		},
+
+		{
+			name:   "Ubuntu",
+			origin: "Ubuntu",
+			label:  "Ubuntu",
+			uri:    "http://archive.ubuntu.com/ubuntu/pool/main/h/hello/hello_2.10-1.dsc",
+			want:   "https://launchpad.example/ubuntu/+archive/primary/+sourcefiles/hello/2.10-1/hello_2.10-1.dsc",
+		},
+
+		{
+			name:   "Configured",
+			origin: "Example",
+			label:  "internal",
+			uri:    "https://apt.example/internal/pool/main/h/hello/hello_2.10-1.dsc",
+			want:   "http://aptly.example/snapshots/2020/pool/main/h/hello/hello_2.10-1.dsc",
+		},
+
+		{
+			name:   "ConfiguredLabelMismatch",
+			origin: "Example",
+			label:  "public",
+			uri:    "https://apt.example/public/pool/main/h/hello/hello_2.10-1.dsc",
+			want:   "",
+		},
+	} {
+		entry := entry // copy
+		t.Run(entry.name, func(t *testing.T) {
+			t.Parallel()
+			b := i.backendFor(entry.origin, entry.label, "hello", "2.10-1")
+			if got, want := b.fallback(entry.uri), entry.want; got != want {
+				t.Fatalf("unexpected fallback: got %q, want %q", got, want)
+			}
+		})
+	}
+}
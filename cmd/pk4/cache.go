@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Debian/pk4/internal/humanbytes"
+	"golang.org/x/sync/errgroup"
+)
+
+// cacheEntry is a unit of eviction from -dest: a source tree together with its
+// stamp and the files it was unpacked from, or a file which no source tree
+// refers to (e.g. a .dsc file left behind by an older pk4 version).
+type cacheEntry struct {
+	name     string   // source tree or file name
+	tree     bool     // false for files
+	stamp    *stamp   // nil for files and source trees without a stamp
+	paths    []string // names of all -dest entries belonging to this entry
+	size     int64
+	lastUsed time.Time
+
+	// links are the hardlinked files of the entry, which are included in
+	// size, but must be counted once in the disk usage of -dest (see
+	// totalSize).
+	links map[fileID]int64
+}
+
+// srcpkg returns the source package name of the entry, or the empty string
+// if it cannot be determined.
+func (e *cacheEntry) srcpkg() string {
+	if e.stamp != nil && e.stamp.Source != "" {
+		return e.stamp.Source
+	}
+	if idx := strings.IndexByte(e.name, '_'); idx > -1 {
+		return e.name[:idx] // file names are <srcpkg>_<version>…
+	}
+	return ""
+}
+
+// version returns the source package version of the entry, or the empty
+// string if it cannot be determined.
+func (e *cacheEntry) version() string {
+	if e.stamp != nil {
+		return e.stamp.Version
+	}
+	return ""
+}
+
+func (e *cacheEntry) pinned() bool {
+	return e.stamp != nil && e.stamp.Pinned
+}
+
+// cacheEntries returns the entries of -dest, least recently used first.
+func (i *invocation) cacheEntries() ([]*cacheEntry, error) {
+	fis, err := ioutil.ReadDir(i.dest)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		trees  []*cacheEntry
+		files  = make(map[string]os.FileInfo)
+		stamps = make(map[string]bool)
+	)
+	for _, fi := range fis {
+		name := fi.Name()
+		switch {
+		case strings.HasPrefix(name, "."):
+			// Skip pk4’s own state, e.g. the snapshot.debian.org cache.
+		case fi.IsDir():
+			e := &cacheEntry{
+				name:     name,
+				tree:     true,
+				paths:    []string{name},
+				lastUsed: fi.ModTime(),
+			}
+			st, err := readStamp(filepath.Join(i.dest, name))
+			if err == nil {
+				e.stamp = st
+				e.lastUsed = st.lastUsed()
+				e.paths = append(e.paths, filepath.Base(stampPath(name)))
+				stamps[filepath.Base(stampPath(name))] = true
+			} else if !os.IsNotExist(err) {
+				i.V().Printf("ignoring unreadable stamp of %s: %v", name, err)
+			}
+			trees = append(trees, e)
+		default:
+			files[name] = fi
+		}
+	}
+
+	// Files shared between versions (e.g. .orig.tar.gz) belong to the
+	// source tree which will be evicted last.
+	owner := make(map[string]*cacheEntry)
+	for _, e := range trees {
+		if e.stamp == nil {
+			continue
+		}
+		for fn := range e.stamp.Sha256 {
+			if _, ok := files[fn]; !ok {
+				continue
+			}
+			if o, ok := owner[fn]; ok && (o.pinned() || !e.pinned() && o.lastUsed.After(e.lastUsed)) {
+				continue
+			}
+			owner[fn] = e
+		}
+	}
+	entries := trees
+	for name, fi := range files {
+		if stamps[name] {
+			continue
+		}
+		if e, ok := owner[name]; ok {
+			e.paths = append(e.paths, name)
+			continue
+		}
+		entries = append(entries, &cacheEntry{
+			name:     name,
+			paths:    []string{name},
+			lastUsed: fi.ModTime(),
+		})
+	}
+
+	var eg errgroup.Group
+	for _, e := range entries {
+		e := e // copy
+		eg.Go(func() error {
+			e.links = make(map[fileID]int64)
+			for _, p := range e.paths {
+				var (
+					size  int64
+					links map[fileID]int64
+					err   error
+				)
+				if e.tree && p == e.name {
+					size, links, err = i.treeSize(e)
+				} else {
+					links = make(map[fileID]int64)
+					size, err = blockUsage(filepath.Join(i.dest, p), links)
+				}
+				if err != nil {
+					return err
+				}
+				e.size += size - addLinks(e.links, links)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].lastUsed.Equal(entries[j].lastUsed) {
+			return entries[i].lastUsed.Before(entries[j].lastUsed)
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries, nil
+}
+
+// totalSize returns the number of bytes used by entries. Unlike the sum of the
+// entry sizes, files which are hardlinked between entries are counted once.
+func totalSize(entries []*cacheEntry) int64 {
+	var total int64
+	seen := make(map[fileID]int64)
+	for _, e := range entries {
+		total += e.size - addLinks(seen, e.links)
+	}
+	return total
+}
+
+// fileID identifies a file for recognizing hardlinks. It is encoded as
+// <dev>:<ino> in stamps.
+type fileID struct {
+	dev, ino uint64
+}
+
+func (id fileID) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d:%d", id.dev, id.ino)), nil
+}
+
+func (id *fileID) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "%d:%d", &id.dev, &id.ino)
+	return err
+}
+
+// addLinks adds the hardlinked files links to seen and returns the number of
+// bytes used by those which were already in seen, i.e. counted twice.
+func addLinks(seen, links map[fileID]int64) (dup int64) {
+	for id, size := range links {
+		if _, ok := seen[id]; ok {
+			dup += size
+			continue
+		}
+		seen[id] = size
+	}
+	return dup
+}
+
+// blockUsage returns the number of bytes allocated on disk for root and (if
+// root is a directory) all files underneath it. Unlike the apparent size,
+// this accounts for sparse files and block rounding. Hardlinked files are
+// counted once: they are recorded in links, and skipped when already present.
+func blockUsage(root string, links map[fileID]int64) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			size += info.Size() // should not happen on Linux
+			return nil
+		}
+		blocks := st.Blocks * 512 // st_blocks is in units of 512 bytes, see stat(2)
+		if st.Nlink > 1 && !info.IsDir() {
+			id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+			if _, ok := links[id]; ok {
+				return nil
+			}
+			links[id] = blocks
+		}
+		size += blocks
+		return nil
+	})
+	return size, err
+}
+
+// maxSizeAge limits how long a size cached in a stamp is used: modifications
+// deeper within the source tree than sizeCurrent checks go unnoticed.
+const maxSizeAge = 24 * time.Hour
+
+// sizeCurrent reports whether the size of the source tree dir, which was
+// cached at at, is still current, i.e. whether neither dir nor its top-level
+// directories nor those in debian/ were modified since, as e.g. builds within
+// the source tree do.
+func sizeCurrent(dir string, at time.Time) (bool, error) {
+	if time.Since(at) > maxSizeAge {
+		return false, nil
+	}
+	for _, d := range []string{dir, filepath.Join(dir, "debian")} {
+		fi, err := os.Lstat(d)
+		if err != nil {
+			if d != dir && os.IsNotExist(err) {
+				continue
+			}
+			return false, err
+		}
+		if fi.ModTime().After(at) {
+			return false, nil
+		}
+		fis, err := ioutil.ReadDir(d)
+		if err != nil {
+			return false, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() && fi.ModTime().After(at) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// treeSize returns the block usage and the hardlinked files (see blockUsage)
+// of the source tree of e. Walking large source trees (e.g. linux) is
+// expensive, so both are cached in the stamp until the source tree is used
+// again or modified (see sizeCurrent).
+func (i *invocation) treeSize(e *cacheEntry) (int64, map[fileID]int64, error) {
+	dir := filepath.Join(i.dest, e.name)
+	st := e.stamp
+	if st != nil && !st.SizeAt.IsZero() && st.SizeAt.After(st.lastUsed()) {
+		current, err := sizeCurrent(dir, st.SizeAt)
+		if err != nil {
+			return 0, nil, err
+		}
+		if current {
+			links := st.Hardlinks
+			if links == nil {
+				links = make(map[fileID]int64)
+			}
+			return st.Size, links, nil
+		}
+	}
+	at := time.Now().UTC()
+	links := make(map[fileID]int64)
+	size, err := blockUsage(dir, links)
+	if err != nil {
+		return 0, nil, err
+	}
+	if st == nil || st.Source == "" {
+		return size, links, nil
+	}
+	// Only cache the size while nobody uses the source tree, which would
+	// render the size stale.
+	l, err := i.tryLock(lockName(st.Source, st.Version))
+	if err == errLocked {
+		return size, links, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer l.Close()
+	if st, err = readStamp(dir); err != nil {
+		return 0, nil, err
+	}
+	st.Size = size
+	st.Hardlinks = links
+	st.SizeAt = at
+	if err := writeStamp(dir, st); err != nil {
+		return 0, nil, err
+	}
+	return size, links, nil
+}
+
+// gitStatus reports whether the source tree dir is a git repository and
+// whether it contains uncommitted changes, which must not be evicted.
+func (i *invocation) gitStatus(dir string) (repo, dirty bool, _ error) {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		if os.IsNotExist(err) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	name, err := i.lookPath("git")
+	if err != nil {
+		return true, true, nil // cannot tell, err on the side of caution
+	}
+	var stdout bytes.Buffer
+	git := exec.Command(name, "status", "--porcelain", "--untracked-files=normal")
+	git.Dir = dir
+	git.Stdout = &stdout
+	if err := git.Run(); err != nil {
+		i.V().Printf("  %v: %v, assuming uncommitted changes", git.Args, err)
+		return true, true, nil
+	}
+	return true, stdout.Len() > 0, nil
+}
+
+// evict removes e, unless it is locked, e.g. because another pk4 process is
+// unpacking it, or a shell is open in it. The caller must hold cacheLock, see
+// downgrade.
+func (i *invocation) evict(e *cacheEntry) (evicted bool, _ error) {
+	held := make(map[string]bool)
+	for _, p := range e.paths {
+		locks, err := i.locksFor(p)
+		if err != nil {
+			return false, err
+		}
+		for _, lock := range locks {
+			if held[lock] {
+				continue
+			}
+			f, err := i.tryLock(lock)
+			if err == errLocked {
+				i.V().Printf("  not deleting %s: in use (%s)", e.name, lock)
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			defer f.Close()
+			held[lock] = true
+		}
+	}
+	for _, p := range e.paths {
+		if err := os.RemoveAll(filepath.Join(i.dest, p)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// errModified terminates the filepath.Walk in modification early.
+var errModified = errors.New("modified")
+
+// modification returns a description of the first local modification found
+// in the source tree of e, or the empty string if the source tree is
+// unmodified. Local modifications are uncommitted git changes, files which
+// were modified after pk4 unpacked the source tree (which includes git
+// commits, as they require modifying files) and patches created by
+// dpkg-source --commit or --auto-commit.
+func (i *invocation) modification(e *cacheEntry) (string, error) {
+	if !e.tree {
+		return "", nil
+	}
+	dir := filepath.Join(i.dest, e.name)
+	repo, dirty, err := i.gitStatus(dir)
+	if err != nil {
+		return "", err
+	}
+	if dirty {
+		return "uncommitted git changes", nil
+	}
+	// Without a time of unpacking (e.g. source trees adopted from versions of
+	// pk4 which did not write stamps yet), any debian-changes patch and any
+	// git commit might be a local modification.
+	unknown := e.stamp == nil || e.stamp.Unpacked.IsZero()
+	patches, err := filepath.Glob(filepath.Join(dir, "debian", "patches", "debian-changes*"))
+	if err != nil {
+		return "", err
+	}
+	for _, patch := range patches {
+		fi, err := os.Stat(patch)
+		if err != nil {
+			return "", err
+		}
+		if unknown || fi.ModTime().After(e.stamp.Unpacked) {
+			return "dpkg-source --commit patch " + filepath.Base(patch), nil
+		}
+	}
+	if unknown {
+		if repo {
+			return "git repository which may contain local commits", nil
+		}
+		// Keep the source tree rather than risk deleting local work.
+		return "unknown whether modified", nil
+	}
+	// Directories are only reported when no file was modified, i.e. when
+	// files were merely deleted or renamed. The top directory is not reported:
+	// after-download hooks such as git-init create .git in it after the stamp
+	// was written. Deleted files in git repositories show up in git status.
+	var modifiedFile, modifiedDir string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir // modified by e.g. git gc
+		}
+		if path == dir || !info.ModTime().After(e.stamp.Unpacked) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if modifiedDir == "" {
+				modifiedDir = rel
+			}
+			return nil
+		}
+		modifiedFile = rel
+		return errModified
+	})
+	if err != nil && err != errModified {
+		return "", err
+	}
+	if modifiedFile != "" {
+		return "modified " + modifiedFile + " after unpacking", nil
+	}
+	if modifiedDir != "" {
+		return "modified " + modifiedDir + " after unpacking", nil
+	}
+	return "", nil
+}
+
+// capDiskUsage evicts the least recently used entries of -dest until -dest
+// uses at most Disk-Usage-Limit minus reserve bytes (e.g. the estimated size of
+// a source tree which is about to be unpacked). Entries of the source package
+// except (if non-empty) are kept, as are pinned source trees and, unless -force
+// is specified, locally modified source trees.
+func (i *invocation) capDiskUsage(except string, reserve int64) error {
+	// Serialize capDiskUsage calls of concurrent downloads, both within this
+	// process (see -versions) and across processes.
+	l, err := i.lock(cacheLock)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	entries, err := i.cacheEntries()
+	if err != nil {
+		return err
+	}
+	sum := totalSize(entries)
+	i.V().Printf("pk4 destdir %s currently uses %s of disk space", i.dest, humanbytes.Format(sum))
+	deleted := false
+	var blockers []string // entries which were not evicted, with the reason
+	remaining := append([]*cacheEntry(nil), entries...)
+	for _, e := range entries {
+		if sum+reserve <= i.diskUsageLimit {
+			break
+		}
+		if except != "" && e.srcpkg() == except {
+			// avoid deleting the package we are about to download/unpack
+			blockers = append(blockers, e.name+": being downloaded")
+			continue
+		}
+		if e.pinned() {
+			blockers = append(blockers, e.name+": pinned")
+			continue
+		}
+		if !i.force {
+			modification, err := i.modification(e)
+			if err != nil {
+				return err
+			}
+			if modification != "" {
+				blockers = append(blockers, e.name+": "+modification)
+				continue
+			}
+		}
+		evicted, err := i.evict(e)
+		if err != nil {
+			return err
+		}
+		if !evicted {
+			blockers = append(blockers, e.name+": in use")
+			continue
+		}
+		i.V().Printf("  deleted %s (%d bytes)", strings.Join(e.paths, ", "), e.size)
+		for idx, r := range remaining {
+			if r == e {
+				remaining = append(remaining[:idx], remaining[idx+1:]...)
+				break
+			}
+		}
+		// Files hardlinked into remaining entries still use disk space.
+		sum = totalSize(remaining)
+		deleted = true
+	}
+	if sum+reserve > i.diskUsageLimit {
+		usage := humanbytes.Format(sum)
+		if reserve > 0 {
+			usage += " plus " + humanbytes.Format(reserve) + " about to be unpacked"
+		}
+		kept := ""
+		if len(blockers) > 0 {
+			kept = ". Kept:\n  " + strings.Join(blockers, "\n  ")
+		}
+		log.Printf("warning: cannot meet Disk-Usage-Limit %s, %s still uses %s%s",
+			humanbytes.Format(i.diskUsageLimit),
+			i.dest,
+			usage,
+			kept)
+	} else if deleted {
+		i.V().Printf("now using %s of disk space (limit: %s)", humanbytes.Format(sum), humanbytes.Format(i.diskUsageLimit))
+	} else {
+		i.V().Printf("already below the limit of %s", humanbytes.Format(i.diskUsageLimit))
+	}
+	return nil
+}
+
+// pin sets the pinned state of the source trees dirs (paths, or names
+// relative to -dest), see -pin and -unpin.
+func (i *invocation) pin(dirs []string, pinned bool) error {
+	if len(dirs) == 0 {
+		return fmt.Errorf("syntax: pk4 -pin|-unpin <dir>…")
+	}
+	for _, dir := range dirs {
+		if !strings.ContainsRune(dir, filepath.Separator) {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				dir = filepath.Join(i.dest, dir)
+			}
+		}
+		dir = filepath.Clean(dir)
+		st, err := readStamp(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%s is not a source tree unpacked by pk4", dir)
+			}
+			return err
+		}
+		// Guard against a concurrent download updating the stamp.
+		l, err := i.lock(lockName(st.Source, st.Version))
+		if err != nil {
+			return err
+		}
+		err = func() error {
+			defer l.Close()
+			if st, err = readStamp(dir); err != nil {
+				return err
+			}
+			st.Pinned = pinned
+			return writeStamp(dir, st)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
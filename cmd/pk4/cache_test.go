@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeCache populates dest with source trees and stamps for testing
+// eviction. The source trees were last used one hour apart, in order.
+func writeCache(t *testing.T, dest string, stamps []*stamp) {
+	t.Helper()
+	base := time.Now().Add(-time.Duration(len(stamps)) * time.Hour).UTC()
+	for idx, st := range stamps {
+		outputDir := filepath.Join(dest, st.Source+"-"+st.Version)
+		writeTree(t, outputDir, map[string]string{
+			"debian/changelog": st.Source + " (" + st.Version + ") unstable; urgency=medium\n",
+		})
+		st.Unpacked = time.Now().UTC()
+		st.LastUsed = base.Add(time.Duration(idx) * time.Hour)
+		if err := writeStamp(outputDir, st); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeTree(t, dest, map[string]string{
+		"hello_2.10.orig.tar.gz":        "shared between versions",
+		"hello_2.10-1.dsc":              "",
+		"hello_2.10-2.dsc":              "",
+		"orphan_1.0-1.dsc":              "",
+		".snapshot/hello/dsc.cache":     "pk4 state",
+		"incomplete-1.0/debian/control": "",
+	})
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.10-2", Sha256: map[string]string{
+			"hello_2.10-2.dsc":       "",
+			"hello_2.10.orig.tar.gz": "",
+		}},
+		{Source: "hello", Version: "2.10-1", Sha256: map[string]string{
+			"hello_2.10-1.dsc":       "",
+			"hello_2.10.orig.tar.gz": "",
+		}},
+	})
+	// Files and source trees without stamp were last used when modified:
+	old := time.Now().Add(-24 * time.Hour)
+	for _, name := range []string{"orphan_1.0-1.dsc", "incomplete-1.0"} {
+		if err := os.Chtimes(filepath.Join(dest, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i := invocation{dest: dest}
+	entries, err := i.cacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	var order []string
+	for _, e := range entries {
+		got[e.name] = e.paths
+		order = append(order, e.name)
+	}
+	want := map[string][]string{
+		"incomplete-1.0":   {"incomplete-1.0"},
+		"orphan_1.0-1.dsc": {"orphan_1.0-1.dsc"},
+		"hello-2.10-2":     {"hello-2.10-2", "hello-2.10-2.pk4.json", "hello_2.10-2.dsc"},
+		// The most recently used version owns the shared files:
+		"hello-2.10-1": {"hello-2.10-1", "hello-2.10-1.pk4.json", "hello_2.10-1.dsc", "hello_2.10.orig.tar.gz"},
+	}
+	for name, paths := range got {
+		sort.Strings(paths)
+		got[name] = paths
+	}
+	for name, paths := range want {
+		sort.Strings(paths)
+		want[name] = paths
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cacheEntries: got paths %v, want %v", got, want)
+	}
+	if want := []string{"incomplete-1.0", "orphan_1.0-1.dsc", "hello-2.10-2", "hello-2.10-1"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("cacheEntries: got order %v, want %v (least recently used first)", order, want)
+	}
+}
+
+func TestCapDiskUsageLRU(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.10-1"},
+		{Source: "i3-wm", Version: "4.16-1"},
+		{Source: "hello", Version: "2.10-2"},
+	})
+	// Using hello 2.10-1 makes i3-wm the least recently used entry:
+	i := invocation{
+		verbose: *verbose,
+		dest:    dest,
+	}
+	if _, err := i.download("hello", "2.10-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := i.cacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entries[0].name, "i3-wm-4.16-1"; got != want {
+		t.Fatalf("least recently used entry: got %s, want %s", got, want)
+	}
+	var sum int64
+	for _, e := range entries {
+		sum += e.size
+	}
+	i.diskUsageLimit = sum - entries[0].size
+	if err := i.capDiskUsage("unrelated", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hello-2.10-1", "hello-2.10-2"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("entry %s unexpectedly evicted: %v", name, err)
+		}
+	}
+	for _, name := range []string{"i3-wm-4.16-1", "i3-wm-4.16-1.pk4.json"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("least recently used entry %s not evicted: %v", name, err)
+		}
+	}
+}
+
+func TestCapDiskUsageKeeps(t *testing.T) {
+	// Not parallel: setGitIdentity modifies the environment.
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "linux-signed-amd64", Version: "5.0.2+1"},
+		{Source: "linux", Version: "5.0.2-1"},
+		{Source: "pinned", Version: "1.0-1"},
+		{Source: "dirty", Version: "1.0-1"},
+	})
+	i := invocation{
+		verbose:        *verbose,
+		dest:           dest,
+		diskUsageLimit: 0,
+		lookPath:       exec.LookPath,
+	}
+	if err := i.pin([]string{"pinned-1.0-1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	st, err := readStamp(filepath.Join(dest, "pinned-1.0-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Pinned {
+		t.Fatalf("pinned-1.0-1 not pinned after -pin")
+	}
+
+	wantKept := []string{"linux-5.0.2-1", "pinned-1.0-1"}
+	if _, err := exec.LookPath("git"); err == nil {
+		defer setGitIdentity()()
+		dirty := filepath.Join(dest, "dirty-1.0-1")
+		for _, args := range [][]string{
+			{"init", "--quiet"},
+			{"add", "."},
+			{"commit", "--quiet", "-m", "import"},
+		} {
+			git := exec.Command("git", args...)
+			git.Dir = dirty
+			if out, err := git.CombinedOutput(); err != nil {
+				t.Fatalf("%v: %v (output: %s)", git.Args, err, out)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dirty, "debian", "changelog"), []byte("modified"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wantKept = append(wantKept, "dirty-1.0-1")
+	}
+
+	if err := i.capDiskUsage("linux", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range wantKept {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("entry %s unexpectedly evicted: %v", name, err)
+		}
+	}
+	// linux-signed-amd64 is a different source package than linux:
+	if _, err := os.Stat(filepath.Join(dest, "linux-signed-amd64-5.0.2+1")); !os.IsNotExist(err) {
+		t.Errorf("linux-signed-amd64 not evicted: %v", err)
+	}
+}
+
+func TestCapDiskUsageModified(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "patched", Version: "1.0-1"},
+		{Source: "committed", Version: "1.0-1"},
+		{Source: "pristine", Version: "1.0-1"},
+		{Source: "gitinit", Version: "1.0-1"},
+		{Source: "adopted", Version: "1.0-1"},
+	})
+	// Pretend the source trees were unpacked an hour ago, then modified:
+	unpacked := time.Now().Add(-1 * time.Hour)
+	for _, name := range []string{"patched-1.0-1", "committed-1.0-1", "pristine-1.0-1", "gitinit-1.0-1"} {
+		dir := filepath.Join(dest, name)
+		for _, path := range []string{dir, filepath.Join(dir, "debian"), filepath.Join(dir, "debian", "changelog")} {
+			if err := os.Chtimes(path, unpacked, unpacked); err != nil {
+				t.Fatal(err)
+			}
+		}
+		st, err := readStamp(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Unpacked = unpacked.UTC()
+		if err := writeStamp(dir, st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Adopted from a version of pk4 which did not write stamps, i.e. when the
+	// source tree was unpacked is unknown:
+	adopted := filepath.Join(dest, "adopted-1.0-1")
+	st, err := readStamp(adopted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Unpacked = time.Time{}
+	if err := writeStamp(adopted, st); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, filepath.Join(dest, "patched-1.0-1"), map[string]string{
+		"src/main.c": "/* fixed */",
+	})
+	writeTree(t, filepath.Join(dest, "committed-1.0-1"), map[string]string{
+		"debian/patches/debian-changes-1.0-1": "--- a/main.c\n+++ b/main.c\n",
+	})
+	wantEvicted := []string{"pristine-1.0-1"}
+	if _, err := exec.LookPath("git"); err == nil {
+		// Like the git-init after-download hook, which runs after the stamp
+		// was written:
+		for _, args := range [][]string{
+			{"init", "--quiet"},
+			{"add", "."},
+			{"-c", "user.name=pk4 test", "-c", "user.email=pk4@example.net", "commit", "--quiet", "-m", "Initial commit"},
+		} {
+			git := exec.Command("git", args...)
+			git.Dir = filepath.Join(dest, "gitinit-1.0-1")
+			if out, err := git.CombinedOutput(); err != nil {
+				t.Fatalf("%v: %v (output: %s)", git.Args, err, out)
+			}
+		}
+		wantEvicted = append(wantEvicted, "gitinit-1.0-1")
+	}
+
+	i := invocation{
+		verbose:        *verbose,
+		dest:           dest,
+		diskUsageLimit: 0,
+		lookPath:       exec.LookPath,
+	}
+	entries, err := i.cacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		modification, err := i.modification(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"patched-1.0-1":   "modified " + filepath.Join("src", "main.c") + " after unpacking",
+			"committed-1.0-1": "dpkg-source --commit patch debian-changes-1.0-1",
+			"pristine-1.0-1":  "",
+			"gitinit-1.0-1":   "",
+			"adopted-1.0-1":   "unknown whether modified",
+		}[e.name]
+		if modification != want {
+			t.Errorf("modification(%s) = %q, want %q", e.name, modification, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := i.cacheCommand(&buf, []string{"rm", "patched"}); err == nil {
+		t.Errorf("-cache rm of a modified source tree unexpectedly succeeded without -force")
+	}
+
+	if err := i.capDiskUsage("", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"patched-1.0-1", "committed-1.0-1", "adopted-1.0-1"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("modified entry %s unexpectedly evicted: %v", name, err)
+		}
+	}
+	for _, name := range wantEvicted {
+		if _, err := os.Stat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("unmodified entry %s not evicted: %v", name, err)
+		}
+	}
+
+	i.force = true
+	if err := i.capDiskUsage("", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"patched-1.0-1", "committed-1.0-1", "adopted-1.0-1"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("modified entry %s not evicted with -force: %v", name, err)
+		}
+	}
+}
+
+func TestBlockUsage(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.10-1"},
+	})
+	tree := filepath.Join(dest, "hello-2.10-1")
+	// A sparse file uses (almost) no blocks despite its apparent size:
+	f, err := os.Create(filepath.Join(tree, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(1 * 1024 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tree, "data"), bytes.Repeat([]byte{'x'}, 1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := blockUsage(tree, make(map[fileID]int64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before >= 1024*1024*1024 {
+		t.Errorf("blockUsage(%s) = %d, which includes the apparent size of the sparse file", tree, before)
+	}
+	if before < 1024*1024 {
+		t.Errorf("blockUsage(%s) = %d, want at least the 1 MiB of data", tree, before)
+	}
+	if err := os.Link(filepath.Join(tree, "data"), filepath.Join(tree, "debian", "data")); err != nil {
+		t.Fatal(err)
+	}
+	after, err := blockUsage(tree, make(map[fileID]int64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before+1024*1024 {
+		t.Errorf("blockUsage(%s) = %d after hardlinking, want < %d (hardlinks counted once)", tree, after, before+1024*1024)
+	}
+
+	// The size is cached in the stamp until the source tree is used again:
+	i := invocation{dest: dest}
+	if _, err := i.cacheEntries(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := readStamp(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != after {
+		t.Fatalf("stamp size = %d, want %d", st.Size, after)
+	}
+	const fake = 42
+	st.Size = fake
+	if err := writeStamp(tree, st); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := i.cacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The entry includes the stamp file, which uses far less than 1 MiB.
+	if got := entries[0].size; got >= 1024*1024 {
+		t.Errorf("cached size not used: got %d, want %d plus the stamp file", got, fake)
+	}
+	if _, err := i.download("hello", "2.10-1"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = i.cacheEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entries[0].size; got < after {
+		t.Errorf("stale cached size used after the source tree was used again: got %d, want >= %d", got, after)
+	}
+}
+
+func TestTotalSizeHardlinks(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.10-1"},
+		{Source: "hello", Version: "2.10-2"},
+	})
+	// e.g. deduplicated by a tool like hardlink(1):
+	data := filepath.Join(dest, "hello-2.10-1", "data")
+	if err := ioutil.WriteFile(data, bytes.Repeat([]byte{'x'}, 1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(data, filepath.Join(dest, "hello-2.10-2", "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	i := invocation{dest: dest}
+	// The second iteration uses the sizes cached in the stamps:
+	for iteration := 0; iteration < 2; iteration++ {
+		entries, err := i.cacheEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum int64
+		for _, e := range entries {
+			if e.size < 1024*1024 {
+				t.Errorf("iteration %d: entry %s size = %d, want at least the 1 MiB of data", iteration, e.name, e.size)
+			}
+			sum += e.size
+		}
+		if got, want := totalSize(entries), sum-1024*1024; got > want {
+			t.Errorf("iteration %d: totalSize = %d, want <= %d (hardlinks counted once)", iteration, got, want)
+		}
+	}
+}
+
+func TestCapDiskUsageHardlinks(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.10-1"},
+		{Source: "hello", Version: "2.10-2"},
+	})
+	data := filepath.Join(dest, "hello-2.10-1", "data")
+	if err := ioutil.WriteFile(data, bytes.Repeat([]byte{'x'}, 1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(data, filepath.Join(dest, "hello-2.10-2", "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	i := invocation{
+		verbose:        *verbose,
+		dest:           dest,
+		diskUsageLimit: 512 * 1024,
+		force:          true, // data was written after unpacking
+	}
+	// Evicting hello-2.10-1 does not free the hardlinked data, which is still
+	// used by hello-2.10-2, so both need to be evicted.
+	if err := i.capDiskUsage("", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hello-2.10-1", "hello-2.10-2"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("entry %s not evicted: %v", name, err)
+		}
+	}
+}
+
+func TestTreeSizeStale(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.10-1"},
+	})
+	tree := filepath.Join(dest, "hello-2.10-1")
+	writeTree(t, tree, map[string]string{
+		"src/data": string(bytes.Repeat([]byte{'x'}, 1024*1024)),
+	})
+
+	i := invocation{dest: dest}
+	// fakeCachedSize pretends that a size of 42 bytes was cached at sizeAt,
+	// after the source tree was last used and modified.
+	fakeCachedSize := func(sizeAt time.Time) {
+		t.Helper()
+		for _, path := range []string{tree, filepath.Join(tree, "debian"), filepath.Join(tree, "src")} {
+			modified := sizeAt.Add(-1 * time.Hour)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+		st, err := readStamp(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.LastUsed = sizeAt.Add(-1 * time.Hour).UTC()
+		st.Size = 42
+		st.Hardlinks = nil
+		st.SizeAt = sizeAt.UTC()
+		if err := writeStamp(tree, st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := func() int64 {
+		t.Helper()
+		entries, err := i.cacheEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries[0].size
+	}
+
+	fakeCachedSize(time.Now().Add(-1 * time.Hour))
+	if got := size(); got >= 1024*1024 {
+		t.Errorf("cached size not used: got %d, want 42 plus the stamp file", got)
+	}
+
+	// e.g. dpkg-buildpackage writes debian/files:
+	fakeCachedSize(time.Now().Add(-1 * time.Hour))
+	if err := ioutil.WriteFile(filepath.Join(tree, "debian", "files"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := size(); got < 1024*1024 {
+		t.Errorf("stale cached size used after debian/ was modified: got %d, want >= 1 MiB", got)
+	}
+
+	fakeCachedSize(time.Now().Add(-2 * maxSizeAge))
+	if got := size(); got < 1024*1024 {
+		t.Errorf("cached size used after %v: got %d, want >= 1 MiB", 2*maxSizeAge, got)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Debian/pk4/internal/humanbytes"
+)
+
+// diskUsage returns the number of bytes used by the entries of -dest.
+func (i *invocation) diskUsage() (int64, error) {
+	entries, err := i.cacheEntries()
+	if err != nil {
+		return 0, err
+	}
+	return totalSize(entries), nil
+}
+
+// listCache prints all entries of -dest, least recently used first.
+func (i *invocation) listCache(w io.Writer) error {
+	entries, err := i.cacheEntries()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PACKAGE\tVERSION\tSIZE\tLAST USED\tPINNED\tGIT\n")
+	for _, e := range entries {
+		pkg, version := e.srcpkg(), e.version()
+		if e.stamp == nil {
+			pkg, version = e.name, "-" // not unpacked by pk4 (or incomplete)
+		}
+		pinned := "no"
+		if e.pinned() {
+			pinned = "yes"
+		}
+		git := "-"
+		if e.tree {
+			repo, dirty, err := i.gitStatus(filepath.Join(i.dest, e.name))
+			if err != nil {
+				return err
+			}
+			if dirty {
+				git = "dirty"
+			} else if repo {
+				git = "clean"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			pkg,
+			version,
+			humanbytes.Format(e.size),
+			e.lastUsed.Local().Format("2006-01-02 15:04"),
+			pinned,
+			git)
+	}
+	return tw.Flush()
+}
+
+// removeFromCache removes all entries of -dest which belong to the source
+// package pkg, or only to its version version if non-empty.
+func (i *invocation) removeFromCache(w io.Writer, pkg, version string) error {
+	l, err := i.lock(cacheLock)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	entries, err := i.cacheEntries()
+	if err != nil {
+		return err
+	}
+	var removed int
+	for _, e := range entries {
+		if e.srcpkg() != pkg {
+			continue
+		}
+		if version != "" && e.version() != version {
+			continue
+		}
+		if !i.force {
+			modification, err := i.modification(e)
+			if err != nil {
+				return err
+			}
+			if modification != "" {
+				return fmt.Errorf("not removing %s: %s (use -force to remove it anyway)", e.name, modification)
+			}
+		}
+		evicted, err := i.evict(e)
+		if err != nil {
+			return err
+		}
+		if !evicted {
+			return fmt.Errorf("%s is in use by another pk4 process", e.name)
+		}
+		fmt.Fprintf(w, "removed %s (%s)\n", strings.Join(e.paths, ", "), humanbytes.Format(e.size))
+		removed++
+	}
+	if removed == 0 {
+		if version != "" {
+			pkg += "=" + version
+		}
+		return fmt.Errorf("%s not found in %s", pkg, i.dest)
+	}
+	return nil
+}
+
+// cacheCommand implements -cache: args are list, du, gc [-limit <bytes>] or
+// rm <pkg>[=<version>].
+func (i *invocation) cacheCommand(w io.Writer, args []string) error {
+	const syntax = "syntax: pk4 -cache list|du|gc [-limit <bytes>]|rm <pkg>[=<version>]"
+	if len(args) == 0 {
+		return fmt.Errorf(syntax)
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return fmt.Errorf(syntax)
+		}
+		return i.listCache(w)
+
+	case "du":
+		if len(args) != 1 {
+			return fmt.Errorf(syntax)
+		}
+		sum, err := i.diskUsage()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\n", humanbytes.Format(sum), i.dest)
+		return nil
+
+	case "gc":
+		fset := flag.NewFlagSet("gc", flag.ContinueOnError)
+		fset.SetOutput(ioutil.Discard)
+		limit := fset.String("limit",
+			"",
+			"Evict entries until -dest uses at most this many bytes (default: Disk-Usage-Limit)")
+		if err := fset.Parse(args[1:]); err != nil || fset.NArg() != 0 {
+			return fmt.Errorf(syntax)
+		}
+		if *limit != "" {
+			v, err := humanbytes.Parse(*limit)
+			if err != nil {
+				return fmt.Errorf("invalid -limit %q: %v", *limit, err)
+			}
+			i.diskUsageLimit = v
+		}
+		before, err := i.diskUsage()
+		if err != nil {
+			return err
+		}
+		if err := i.capDiskUsage("", 0); err != nil {
+			return err
+		}
+		after, err := i.diskUsage()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "freed %s, now using %s (limit: %s)\n",
+			humanbytes.Format(before-after),
+			humanbytes.Format(after),
+			humanbytes.Format(i.diskUsageLimit))
+		return nil
+
+	case "rm":
+		if len(args) != 2 {
+			return fmt.Errorf(syntax)
+		}
+		pkg, version := args[1], ""
+		if idx := strings.IndexByte(pkg, '='); idx > -1 {
+			pkg, version = pkg[:idx], pkg[idx+1:]
+		}
+		return i.removeFromCache(w, pkg, version)
+	}
+	return fmt.Errorf(syntax)
+}
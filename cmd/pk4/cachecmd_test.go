@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheCommand(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.10-1", Pinned: true},
+		{Source: "hello", Version: "2.10-2"},
+		{Source: "i3-wm", Version: "4.16-1"},
+	})
+
+	i := invocation{
+		verbose:        *verbose,
+		dest:           dest,
+		diskUsageLimit: 1 * 1024 * 1024 * 1024,
+	}
+	var buf bytes.Buffer
+	if err := i.cacheCommand(&buf, []string{"list"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if got, want := len(lines), 4; got != want {
+		t.Fatalf("-cache list: got %d lines, want %d:\n%s", got, want, buf.String())
+	}
+	for idx, want := range [][]string{
+		{"PACKAGE", "VERSION", "SIZE", "LAST", "USED", "PINNED", "GIT"},
+		{"hello", "2.10-1", "yes", "-"},
+		{"hello", "2.10-2", "no", "-"},
+		{"i3-wm", "4.16-1", "no", "-"},
+	} {
+		fields := strings.Fields(lines[idx])
+		for _, field := range want {
+			found := false
+			for _, f := range fields {
+				found = found || f == field
+			}
+			if !found {
+				t.Errorf("-cache list: line %q does not contain %q", lines[idx], field)
+			}
+		}
+	}
+
+	buf.Reset()
+	if err := i.cacheCommand(&buf, []string{"du"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "\t"+dest+"\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("-cache du: got %q, want suffix %q", got, want)
+	}
+
+	if err := i.cacheCommand(&buf, []string{"rm", "i3-wm=4.16-2"}); err == nil {
+		t.Errorf("-cache rm of a version which is not present unexpectedly succeeded")
+	}
+	if err := i.cacheCommand(&buf, []string{"rm", "i3-wm"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "i3-wm-4.16-1")); !os.IsNotExist(err) {
+		t.Errorf("i3-wm-4.16-1 not removed: %v", err)
+	}
+
+	if err := i.cacheCommand(&buf, []string{"gc", "-limit", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "hello-2.10-1")); err != nil {
+		t.Errorf("pinned hello-2.10-1 unexpectedly evicted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "hello-2.10-2")); !os.IsNotExist(err) {
+		t.Errorf("hello-2.10-2 not evicted: %v", err)
+	}
+
+	if err := i.cacheCommand(&buf, []string{"gc", "-limit"}); err == nil {
+		t.Errorf("-cache gc -limit without value unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/changelog"
+	"pault.ag/go/debian/version"
+)
+
+// poolPrefix returns the pool/ subdirectory of srcpkg, e.g. “h” for hello and
+// “libx” for libx11.
+func poolPrefix(srcpkg string) string {
+	if strings.HasPrefix(srcpkg, "lib") && len(srcpkg) > 3 {
+		return srcpkg[:4]
+	}
+	return srcpkg[:1]
+}
+
+// metadataChangelog fetches the debian/changelog of srcpkg in srcversion from
+// metadata.ftp-master.debian.org, which avoids downloading the entire source
+// package.
+func (i *invocation) metadataChangelog(srcpkg, srcversion string) (changelog.ChangelogEntries, error) {
+	v, err := version.Parse(srcversion)
+	if err != nil {
+		return nil, err
+	}
+	v.Epoch = 0
+	var lastErr error
+	for _, component := range components {
+		u, err := url.Parse(i.metadataBase)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = path.Join(u.Path, "changelogs", component, poolPrefix(srcpkg), srcpkg, srcpkg+"_"+v.String()+"_changelog")
+		i.V().Printf("fetching changelog from %s", u.String())
+		rc, err := i.fetch(u.String())
+		if err != nil {
+			lastErr = err
+			if unavailable(err) {
+				continue // try the next component
+			}
+			return nil, err
+		}
+		entries, err := changelog.Parse(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", u.String(), err)
+		}
+		return entries, nil
+	}
+	return nil, lastErr
+}
+
+// changelogSince writes the changelog entries of srcpkg which are newer than
+// installed, up to and including candidate, to w.
+func (i *invocation) changelogSince(w io.Writer, srcpkg, installed, candidate string) error {
+	installedVersion, err := version.Parse(installed)
+	if err != nil {
+		return err
+	}
+	entries, err := i.metadataChangelog(srcpkg, candidate)
+	if err != nil {
+		i.V().Printf("fetching changelog from metadata.ftp-master.debian.org failed (%v), downloading source package", err)
+		outputDir, err := i.download(srcpkg, candidate)
+		if err != nil {
+			return err
+		}
+		entries, err = changelog.ParseFile(filepath.Join(outputDir, "debian", "changelog"))
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range newerEntries(entries, installedVersion) {
+		writeChangelogEntry(w, entry)
+	}
+	return nil
+}
+
+// changelog implements -changelog: it prints the changelog entries between the
+// installed version and the candidate version of the package arg.
+func (i *invocation) changelog(w io.Writer, arg string) error {
+	i.arg = arg
+	srcpkg, _, err := i.resolve()
+	if err != nil {
+		return err
+	}
+	installed, err := i.installedVersion(srcpkg)
+	if err != nil {
+		return err
+	}
+	candidate, err := i.candidateVersion(srcpkg)
+	if err != nil {
+		return err
+	}
+	if installed == candidate {
+		i.V().Printf("installed version %s of %s is the candidate version", installed, srcpkg)
+		return nil
+	}
+	i.V().Printf("printing changelog of %s between installed version %s and candidate version %s", srcpkg, installed, candidate)
+	return i.changelogSince(w, srcpkg, installed, candidate)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const helloChangelog = `hello (2.10-3) unstable; urgency=medium
+
+  * Third.
+
+ -- Santiago Vila <sanvila@debian.org>  Tue, 11 Jul 2017 10:12:32 +0200
+
+hello (2.10-2) unstable; urgency=medium
+
+  * Second.
+
+ -- Santiago Vila <sanvila@debian.org>  Mon, 10 Jul 2017 10:12:32 +0200
+
+hello (2.10-1) unstable; urgency=low
+
+  * New upstream release.
+
+ -- Santiago Vila <sanvila@debian.org>  Sun, 22 Mar 2015 11:48:01 +0100
+`
+
+func TestChangelogSince(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/changelogs/main/h/hello/hello_2.10-3_changelog", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(helloChangelog))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	i := invocation{
+		verbose:      *verbose,
+		metadataBase: ts.URL + "/",
+	}
+	var buf bytes.Buffer
+	if err := i.changelogSince(&buf, "hello", "2.10-1", "2.10-3"); err != nil {
+		t.Fatal(err)
+	}
+	want := `hello (2.10-3) unstable; urgency=medium
+
+  * Third.
+
+ -- Santiago Vila <sanvila@debian.org>  Tue, 11 Jul 2017 10:12:32 +0200
+
+hello (2.10-2) unstable; urgency=medium
+
+  * Second.
+
+ -- Santiago Vila <sanvila@debian.org>  Mon, 10 Jul 2017 10:12:32 +0200
+
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected changelog: got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -52,12 +52,12 @@ func TestComplete(t *testing.T) {
 			name string
 			want []string
 
-			invocation
+			*invocation
 		}{
 			{
 				name: "Bin",
 				want: bin,
-				invocation: invocation{
+				invocation: &invocation{
 					bin: true,
 				},
 			},
@@ -65,7 +65,7 @@ func TestComplete(t *testing.T) {
 			{
 				name: "Src",
 				want: src,
-				invocation: invocation{
+				invocation: &invocation{
 					src: true,
 				},
 			},
@@ -78,7 +78,7 @@ func TestComplete(t *testing.T) {
 			{
 				name: "BothPrefix",
 				want: []string{"xorg-server"},
-				invocation: invocation{
+				invocation: &invocation{
 					arg: "x",
 				},
 			},
@@ -89,6 +89,9 @@ func TestComplete(t *testing.T) {
 				t.Parallel()
 
 				i := entry.invocation
+				if i == nil {
+					i = &invocation{}
+				}
 				i.indexDir = indexDir
 
 				got, err := i.complete()
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// installedVersions returns the installed version of those binary packages
+// pkgs which are installed.
+func (i *invocation) installedVersions(pkgs []string) (map[string]string, error) {
+	name, err := i.lookPath("dpkg-query")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-f", "${db:Status-Status}\t${Package}\t${Version}\n", "--show"}
+	query := exec.Command(name, append(args, pkgs...)...)
+	// Intentionally discard stderr: dpkg-query will print one line to stderr
+	// for each package which is not known.
+	out, err := query.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, err
+		}
+		// exec.ExitError is okay, dpkg-query still returns partial output.
+	}
+	installed := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.Split(line, "\t")
+		if len(parts) != 3 || parts[0] != "installed" {
+			continue
+		}
+		installed[parts[1]] = parts[2]
+	}
+	return installed, nil
+}
+
+// downloadDbgsym downloads the debug symbol packages (-dbgsym) matching the
+// installed binary packages built from srcpkg in srcversion into -dest. It
+// returns the paths of the downloaded files.
+func (i *invocation) downloadDbgsym(srcpkg, srcversion string) ([]string, error) {
+	files, arch, err := i.findDebs("dbgsym.index", srcpkg, srcversion)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dbgsyms []debFile
+		pkgs    []string
+	)
+	for _, f := range files {
+		if !isDbgsym(f.pkg) {
+			continue // snapshot.debian.org lists all binary packages
+		}
+		dbgsyms = append(dbgsyms, f)
+		pkgs = append(pkgs, strings.TrimSuffix(f.pkg, "-dbgsym"))
+	}
+	if len(dbgsyms) == 0 {
+		return nil, fmt.Errorf("%s %s: no debug symbol packages for architecture %s found. Is a debug archive (e.g. deb http://deb.debian.org/debian-debug/ bookworm-debug main) configured in your apt sources?", srcpkg, srcversion, arch)
+	}
+
+	installed, err := i.installedVersions(pkgs)
+	if err != nil {
+		return nil, err
+	}
+	matching := dbgsyms[:0]
+	for idx, f := range dbgsyms {
+		version, ok := installed[pkgs[idx]]
+		if !ok {
+			continue
+		}
+		if version != f.version {
+			log.Printf("skipping %s: %s %s is installed, but %s contains debug symbols for %s", f.name, pkgs[idx], version, f.name, f.version)
+			continue
+		}
+		matching = append(matching, f)
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("%s %s: none of the binary packages with debug symbols (%s) is installed", srcpkg, srcversion, strings.Join(pkgs, ", "))
+	}
+	return i.downloadAll(matching)
+}
+
+// installDebs installs the .deb files paths, like pk4-replace.
+func installDebs(paths []string) error {
+	install := exec.Command("sudo", append([]string{"dpkg", "-i"}, paths...)...)
+	log.Printf("Installing packages using %q", install.Args)
+	install.Stdout = os.Stdout
+	install.Stderr = os.Stderr
+	return install.Run()
+}
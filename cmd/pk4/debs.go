@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Debian/pk4/internal/write"
+	"golang.org/x/sync/errgroup"
+)
+
+// debFile is a binary package file to download into -dest.
+type debFile struct {
+	pkg     string // binary package name, e.g. hello
+	version string // binary package version
+	name    string // file name, e.g. hello_2.10-1_amd64.deb
+	url     string
+
+	// newHash and sum (hex-encoded) are used to verify the downloaded file.
+	newHash func() hash.Hash
+	sum     string
+}
+
+// hostArchitecture returns the architecture of the host, e.g. amd64.
+func (i *invocation) hostArchitecture() (string, error) {
+	name, err := i.lookPath("dpkg")
+	if err != nil {
+		return "", err
+	}
+	dpkg := exec.Command(name, "--print-architecture")
+	dpkg.Stderr = os.Stderr
+	out, err := dpkg.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", dpkg.Args, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// debsFromIndex returns the binary packages built from srcpkg in srcversion
+// for the architectures arches, as per the pk4 index file indexName.
+func (i *invocation) debsFromIndex(indexName, srcpkg, srcversion string, arches map[string]bool) ([]debFile, error) {
+	debs, err := i.lookupDebs(indexName, srcpkg, srcversion)
+	if err != nil {
+		return nil, err
+	}
+	var files []debFile
+	for _, deb := range debs {
+		if !arches[deb.Architecture] {
+			continue
+		}
+		files = append(files, debFile{
+			pkg:     deb.Package,
+			version: deb.Version,
+			name:    path.Base(deb.URL),
+			url:     deb.URL,
+			newHash: sha256.New,
+			sum:     deb.SHA256,
+		})
+	}
+	return files, nil
+}
+
+// debsFromSnapshot returns the binary packages built from srcpkg in
+// srcversion for the architectures arches, as per snapshot.debian.org.
+func (i *invocation) debsFromSnapshot(srcpkg, srcversion string, arches map[string]bool) ([]debFile, error) {
+	c := i.snapshotClient()
+	binpkgs, err := c.BinPackages(srcpkg, srcversion)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", srcpkg, srcversion, err)
+	}
+	var files []debFile
+	for _, binpkg := range binpkgs {
+		binfiles, err := c.BinFiles(binpkg.Name, binpkg.Version)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", binpkg.Name, binpkg.Version, err)
+		}
+		for _, binfile := range binfiles.Result {
+			if !arches[binfile.Architecture] {
+				continue
+			}
+			infos := binfiles.Fileinfo[binfile.Hash]
+			if len(infos) == 0 {
+				return nil, fmt.Errorf("%s %s: no fileinfo for %s", binpkg.Name, binpkg.Version, binfile.Hash)
+			}
+			files = append(files, debFile{
+				pkg:     binpkg.Name,
+				version: binpkg.Version,
+				name:    infos[0].Name,
+				url:     c.FileURL(binfile.Hash),
+				newHash: sha1.New, // snapshot.debian.org identifies files by SHA1
+				sum:     binfile.Hash,
+			})
+		}
+	}
+	return files, nil
+}
+
+// verifyFile returns an error if the checksum of the file at path does not
+// match f.sum.
+func verifyFile(path string, f debFile) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := f.newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != f.sum {
+		return fmt.Errorf("%s: checksum mismatch: got %s, want %s", path, got, f.sum)
+	}
+	return nil
+}
+
+// downloadVerified downloads f into -dest unless a verified copy already
+// exists. It returns the path of the downloaded file.
+func (i *invocation) downloadVerified(f debFile) (string, error) {
+	dest := filepath.Join(i.dest, f.name)
+	if err := verifyFile(dest, f); err == nil {
+		return dest, nil // file already exists
+	} else if !os.IsNotExist(err) {
+		i.V().Printf("downloading %s again: %v", f.name, err)
+	}
+	err := write.Atomically(dest, func(w io.Writer) error {
+		i.V().Printf("downloading %s", f.url)
+		rc, err := i.fetch(f.url)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		h := f.newHash()
+		if _, err := io.Copy(io.MultiWriter(w, h), rc); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != f.sum {
+			return fmt.Errorf("%s: checksum mismatch: got %s, want %s", f.url, got, f.sum)
+		}
+		return nil
+	})
+	return dest, err
+}
+
+// findDebs returns the binary packages built from srcpkg in srcversion for
+// the host architecture, as per the pk4 index file indexName, falling back to
+// snapshot.debian.org. The returned architecture is the host architecture.
+func (i *invocation) findDebs(indexName, srcpkg, srcversion string) ([]debFile, string, error) {
+	arch, err := i.hostArchitecture()
+	if err != nil {
+		return nil, "", err
+	}
+	arches := map[string]bool{arch: true, "all": true}
+
+	files, err := i.debsFromIndex(indexName, srcpkg, srcversion, arches)
+	if err != nil {
+		if err != notFound && !os.IsNotExist(err) {
+			return nil, "", err
+		}
+		if i.offline {
+			return nil, "", fmt.Errorf("%s %s not found in the pk4 index, and -offline forbids falling back to snapshot.debian.org", srcpkg, srcversion)
+		}
+		// fallback to snapshot.debian.org lookup
+		files, err = i.debsFromSnapshot(srcpkg, srcversion, arches)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return files, arch, nil
+}
+
+// downloadAll downloads files in parallel and returns their paths.
+func (i *invocation) downloadAll(files []debFile) ([]string, error) {
+	paths := make([]string, len(files))
+	var eg errgroup.Group
+	for idx, f := range files {
+		idx, f := idx, f // copy
+		eg.Go(func() error {
+			var err error
+			paths[idx], err = i.downloadVerified(f)
+			return err
+		})
+	}
+	return paths, eg.Wait()
+}
+
+// isDbgsym returns whether pkg is an automatic debug symbol package, see
+// https://wiki.debian.org/AutomaticDebugPackages
+func isDbgsym(pkg string) bool {
+	return strings.HasSuffix(pkg, "-dbgsym")
+}
+
+// downloadDebs downloads all binary packages built from srcpkg in srcversion
+// for the host architecture into -dest, next to the .dsc file. It returns the
+// paths of the downloaded files.
+func (i *invocation) downloadDebs(srcpkg, srcversion string) ([]string, error) {
+	files, arch, err := i.findDebs("debs.index", srcpkg, srcversion)
+	if err != nil {
+		return nil, err
+	}
+	// snapshot.debian.org lists the debug symbol packages, too.
+	debs := files[:0]
+	for _, f := range files {
+		if !isDbgsym(f.pkg) {
+			debs = append(debs, f)
+		}
+	}
+	if len(debs) == 0 {
+		return nil, fmt.Errorf("%s %s: no binary packages for architecture %s or all found", srcpkg, srcversion, arch)
+	}
+	return i.downloadAll(debs)
+}
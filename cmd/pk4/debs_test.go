@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Debian/pk4/internal/index"
+)
+
+func TestDownloadDebs(t *testing.T) {
+	t.Parallel()
+
+	debs := map[string]string{
+		"hello_2.10-1_amd64.deb":        "fake amd64 deb",
+		"hello_2.10-1_i386.deb":         "fake i386 deb",
+		"hello-doc_2.10-1_all.deb":      "fake all deb",
+		"hello-dbgsym_2.10-1_amd64.deb": "fake dbgsym deb",
+	}
+	sha1sum := func(name string) string {
+		h := sha1.Sum([]byte(debs[name]))
+		return hex.EncodeToString(h[:])
+	}
+	sha256sum := func(name string) string {
+		h := sha256.Sum256([]byte(debs[name]))
+		return hex.EncodeToString(h[:])
+	}
+
+	for _, entry := range []struct {
+		name      string
+		fromIndex bool
+		corrupt   bool
+	}{
+		{name: "Index", fromIndex: true},
+		{name: "Snapshot"},
+		{name: "ChecksumMismatch", fromIndex: true, corrupt: true},
+	} {
+		entry := entry // copy
+		t.Run(entry.name, func(t *testing.T) {
+			t.Parallel()
+
+			dest, err := ioutil.TempDir("", "pk4test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dest)
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/mr/package/hello/2.10-1/binpackages", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"result": [{"name": "hello", "version": "2.10-1"}, {"name": "hello-doc", "version": "2.10-1"}]}`))
+			})
+			mux.HandleFunc("/mr/binary/hello/2.10-1/binfiles", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"result": [{"hash": %q, "architecture": "amd64"}, {"hash": %q, "architecture": "i386"}], "fileinfo": {%q: [{"name": "hello_2.10-1_amd64.deb"}], %q: [{"name": "hello_2.10-1_i386.deb"}]}}`,
+					sha1sum("hello_2.10-1_amd64.deb"),
+					sha1sum("hello_2.10-1_i386.deb"),
+					sha1sum("hello_2.10-1_amd64.deb"),
+					sha1sum("hello_2.10-1_i386.deb"))
+			})
+			mux.HandleFunc("/mr/binary/hello-doc/2.10-1/binfiles", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"result": [{"hash": %q, "architecture": "all"}], "fileinfo": {%q: [{"name": "hello-doc_2.10-1_all.deb"}]}}`,
+					sha1sum("hello-doc_2.10-1_all.deb"),
+					sha1sum("hello-doc_2.10-1_all.deb"))
+			})
+			for name := range debs {
+				name := name // copy
+				mux.HandleFunc("/file/"+sha1sum(name), func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte(debs[name]))
+				})
+				mux.HandleFunc("/debian/pool/main/h/hello/"+name, func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte(debs[name]))
+				})
+			}
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			i := invocation{
+				snapshotBase: ts.URL + "/",
+				verbose:      *verbose,
+				dest:         dest,
+				indexDir:     dest,
+				lookPath: func(file string) (string, error) {
+					fake := filepath.Join("testdata", "Debs", file)
+					return filepath.Abs(fake)
+				},
+			}
+
+			if entry.fromIndex {
+				var idx []index.Deb
+				for _, deb := range []struct{ pkg, arch, name string }{
+					{"hello", "amd64", "hello_2.10-1_amd64.deb"},
+					{"hello", "i386", "hello_2.10-1_i386.deb"},
+					{"hello-doc", "all", "hello-doc_2.10-1_all.deb"},
+				} {
+					sum := sha256sum(deb.name)
+					if entry.corrupt {
+						sum = sha256sum("hello-dbgsym_2.10-1_amd64.deb")
+					}
+					idx = append(idx, index.Deb{
+						Package:      deb.pkg,
+						Version:      "2.10-1",
+						Architecture: deb.arch,
+						URL:          ts.URL + "/debian/pool/main/h/hello/" + deb.name,
+						SHA256:       sum,
+						Size:         int64(len(debs[deb.name])),
+					})
+				}
+				f, err := os.Create(filepath.Join(dest, "debs.index"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				src := index.Source{Package: "hello", Version: mustParseVersion("2.10-1")}
+				if err := (index.Debs{src: idx}).Encode(f); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			paths, err := i.downloadDebs("hello", "2.10-1")
+			if entry.corrupt {
+				if err == nil {
+					t.Fatalf("downloadDebs unexpectedly succeeded despite checksum mismatches")
+				}
+				if _, err := os.Stat(filepath.Join(dest, "hello_2.10-1_amd64.deb")); !os.IsNotExist(err) {
+					t.Fatalf("unverified file left behind: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{
+				filepath.Join(dest, "hello_2.10-1_amd64.deb"),
+				filepath.Join(dest, "hello-doc_2.10-1_all.deb"),
+			}
+			if !reflect.DeepEqual(paths, want) {
+				t.Fatalf("downloadDebs: got %v, want %v", paths, want)
+			}
+			for _, path := range paths {
+				b, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := string(b), debs[filepath.Base(path)]; got != want {
+					t.Errorf("%s: got %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadDbgsym(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	const contents = "fake dbgsym deb"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debian-debug/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(contents))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	h := sha256.Sum256([]byte(contents))
+	sum := hex.EncodeToString(h[:])
+	var idx []index.Deb
+	for _, deb := range []struct{ pkg, version, arch string }{
+		{"hello-dbgsym", "2.10-1", "amd64"},
+		{"hello-dbgsym", "2.10-1", "i386"},
+		{"hello-tools-dbgsym", "2.10-1", "amd64"}, // hello-tools 2.9-1 installed
+		{"hello-doc-dbgsym", "2.10-1", "amd64"},   // hello-doc not installed
+	} {
+		name := deb.pkg + "_" + deb.version + "_" + deb.arch + ".deb"
+		idx = append(idx, index.Deb{
+			Package:      deb.pkg,
+			Version:      deb.version,
+			Architecture: deb.arch,
+			URL:          ts.URL + "/debian-debug/pool/main/h/hello/" + name,
+			SHA256:       sum,
+			Size:         int64(len(contents)),
+		})
+	}
+	f, err := os.Create(filepath.Join(dest, "dbgsym.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := index.Source{Package: "hello", Version: mustParseVersion("2.10-1")}
+	if err := (index.Debs{src: idx}).Encode(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i := invocation{
+		verbose:  *verbose,
+		dest:     dest,
+		indexDir: dest,
+		lookPath: func(file string) (string, error) {
+			fake := filepath.Join("testdata", "Debs", file)
+			return filepath.Abs(fake)
+		},
+	}
+	paths, err := i.downloadDbgsym("hello", "2.10-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths, []string{filepath.Join(dest, "hello-dbgsym_2.10-1_amd64.deb")}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("downloadDbgsym: got %v, want %v", got, want)
+	}
+
+	// A source package without debug symbol packages:
+	if _, err := i.downloadDbgsym("hello", "2.10-2"); err == nil {
+		t.Fatalf("downloadDbgsym unexpectedly succeeded for a version without debug symbol packages")
+	}
+}
+
+func TestLookupEmptyIndex(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	// e.g. dbgsym.index without debug Packages targets:
+	f, err := os.Create(filepath.Join(dest, "dbgsym.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := (index.Debs{}).Encode(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	i := invocation{indexDir: dest}
+	if _, err := i.lookupDebs("dbgsym.index", "hello", "2.10-1"); err != notFound {
+		t.Fatalf("lookupDebs in an empty index: got err %v, want %v", err, notFound)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/changelog"
+)
+
+// dep14Version mangles a Debian version for use in a git tag name as per
+// https://dep-team.pages.debian.net/deps/dep14/, e.g. 1:2.3~rc1-1 becomes
+// 1%2.3_rc1-1.
+func dep14Version(v string) string {
+	v = strings.Replace(v, ":", "%", -1)
+	v = strings.Replace(v, "~", "_", -1)
+	for strings.Contains(v, "..") {
+		v = strings.Replace(v, "..", ".#.", -1)
+	}
+	if strings.HasSuffix(v, ".") {
+		v += "#"
+	}
+	if strings.HasSuffix(v, ".lock") {
+		v = strings.TrimSuffix(v, ".lock") + ".#lock"
+	}
+	return v
+}
+
+func (i *invocation) git(dir string, args ...string) error {
+	name, err := i.lookPath("git")
+	if err != nil {
+		return err
+	}
+	git := exec.Command(name, append([]string{"-C", dir}, args...)...)
+	git.Stderr = os.Stderr
+	if i.verbose {
+		git.Stdout = os.Stderr
+	}
+	if err := git.Run(); err != nil {
+		return fmt.Errorf("%v: %v", git.Args, err)
+	}
+	return nil
+}
+
+// dgitClone makes available srcpkg in srcversion in dest as a git repository
+// with history, using dgit(1). It returns false if dgit has no history for
+// srcversion, in which case the caller should fall back to the .dsc file.
+func (i *invocation) dgitClone(dest, srcpkg, srcversion string) (ok bool, _ error) {
+	if i.offline {
+		return false, nil
+	}
+	name, err := i.lookPath("dgit")
+	if err != nil {
+		log.Printf("Backend dgit requested, but dgit is not installed (%v), falling back to the .dsc file", err)
+		return false, nil
+	}
+
+	tmp, err := i.stagingDir()
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	clone := filepath.Join(tmp, "src")
+
+	i.V().Printf("cloning %s from suite %s using dgit", srcpkg, i.suite)
+	dgit := exec.Command(name, "clone", srcpkg, i.suite, clone)
+	dgit.Dir = tmp
+	dgit.Stderr = os.Stderr
+	if i.verbose {
+		dgit.Stdout = os.Stderr
+	}
+	if err := dgit.Run(); err != nil {
+		i.V().Printf("dgit clone failed (%v), falling back to the .dsc file", err)
+		return false, nil
+	}
+
+	latest, err := changelog.ParseFileOne(filepath.Join(clone, "debian", "changelog"))
+	if err != nil {
+		return false, err
+	}
+	if latest.Version.String() != srcversion {
+		// The suite contains a different version: check out the archive tag
+		// of the requested version, if dgit has history for it.
+		tag := "archive/debian/" + dep14Version(srcversion)
+		i.V().Printf("suite %s contains %s, fetching tag %s", i.suite, latest.Version, tag)
+		if err := i.git(clone, "fetch", "--quiet", "dgit", "refs/tags/"+tag+":refs/tags/"+tag); err != nil {
+			i.V().Printf("dgit has no history for %s %s (%v), falling back to the .dsc file", srcpkg, srcversion, err)
+			return false, nil
+		}
+		if err := i.git(clone, "checkout", "--quiet", "-B", "pk4/"+dep14Version(srcversion), tag); err != nil {
+			return false, err
+		}
+	}
+
+	if err := os.Rename(clone, dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestDep14Version(t *testing.T) {
+	t.Parallel()
+
+	for _, entry := range []struct {
+		version string
+		want    string
+	}{
+		{"2.10-1", "2.10-1"},
+		{"2:1.19.3-2", "2%1.19.3-2"},
+		{"1.0~rc1-1", "1.0_rc1-1"},
+		{"1.0...2", "1.0.#.#.2"},
+		{"1.0.", "1.0.#"},
+		{"1.0.lock", "1.0.#lock"},
+	} {
+		if got := dep14Version(entry.version); got != entry.want {
+			t.Errorf("dep14Version(%q) = %q, want %q", entry.version, got, entry.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/changelog"
+	"pault.ag/go/debian/version"
+)
+
+// dscName returns the file name of the .dsc file of srcpkg in srcversion, e.g.
+// xorg-server_1.19.3-2.dsc for 2:1.19.3-2 (the epoch is not part of file names).
+func dscName(srcpkg, srcversion string) (string, error) {
+	v, err := version.Parse(srcversion)
+	if err != nil {
+		return "", err
+	}
+	v.Epoch = 0
+	return srcpkg + "_" + v.String() + ".dsc", nil
+}
+
+// seriesEntry is a line of a quilt series file: a patch name and the strip
+// level with which to apply it.
+type seriesEntry struct {
+	name  string
+	strip string // e.g. 1 for -p1
+}
+
+// readSeriesEntries returns the patches listed in the quilt series file of the
+// source tree dir, if any.
+func readSeriesEntries(dir string) ([]seriesEntry, error) {
+	f, err := os.Open(filepath.Join(dir, "debian", "patches", "series"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []seriesEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx > -1 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		entry := seriesEntry{name: fields[0], strip: "1"}
+		for _, option := range fields[1:] {
+			if strings.HasPrefix(option, "-p") {
+				entry.strip = strings.TrimPrefix(option, "-p")
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// readSeries returns the patch names listed in the quilt series file of the
+// source tree dir, if any.
+func readSeries(dir string) ([]string, error) {
+	entries, err := readSeriesEntries(dir)
+	if err != nil {
+		return nil, err
+	}
+	var patches []string
+	for _, entry := range entries {
+		patches = append(patches, entry.name)
+	}
+	return patches, nil
+}
+
+// listFiles returns the contents of all files underneath root, keyed by their
+// path relative to root. Symbolic links are represented by their target.
+func listFiles(root string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			files[rel] = []byte("-> " + target)
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = b
+		return nil
+	})
+	return files, err
+}
+
+// debianChanges returns one line per file which was added (A), deleted (D) or
+// modified (M) in the debian/ directory between the trees oldDir and newDir.
+func debianChanges(oldDir, newDir string) ([]string, error) {
+	oldFiles, err := listFiles(filepath.Join(oldDir, "debian"))
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := listFiles(filepath.Join(newDir, "debian"))
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for path, oldContents := range oldFiles {
+		newContents, ok := newFiles[path]
+		if !ok {
+			changes = append(changes, "D debian/"+path)
+		} else if !bytes.Equal(oldContents, newContents) {
+			changes = append(changes, "M debian/"+path)
+		}
+	}
+	for path := range newFiles {
+		if _, ok := oldFiles[path]; !ok {
+			changes = append(changes, "A debian/"+path)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i][2:] < changes[j][2:]
+	})
+	return changes, nil
+}
+
+// changelogBetween returns the entries of the debian/changelog file of the
+// tree dir which are newer than oldVersion.
+func changelogBetween(dir string, oldVersion version.Version) (changelog.ChangelogEntries, error) {
+	entries, err := changelog.ParseFile(filepath.Join(dir, "debian", "changelog"))
+	if err != nil {
+		return nil, err
+	}
+	return newerEntries(entries, oldVersion), nil
+}
+
+// newerEntries returns all entries newer than oldVersion. Entries are sorted
+// newest first, like in debian/changelog.
+func newerEntries(entries changelog.ChangelogEntries, oldVersion version.Version) changelog.ChangelogEntries {
+	var newer changelog.ChangelogEntries
+	for _, entry := range entries {
+		if version.Compare(entry.Version, oldVersion) <= 0 {
+			break
+		}
+		newer = append(newer, entry)
+	}
+	return newer
+}
+
+// writeChangelogEntry writes entry in debian/changelog format.
+func writeChangelogEntry(w io.Writer, entry changelog.ChangelogEntry) {
+	var args []string
+	for key, val := range entry.Arguments {
+		if key == "" {
+			continue
+		}
+		args = append(args, key+"="+val)
+	}
+	sort.Strings(args)
+	fmt.Fprintf(w, "%s (%s) %s; %s\n", entry.Source, entry.Version, entry.Target, strings.Join(args, ", "))
+	fmt.Fprintf(w, "%s", entry.Changelog)
+	fmt.Fprintf(w, " -- %s  %s\n\n", entry.ChangedBy, entry.When.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+}
+
+// summarize prints which debian/ files, patches and changelog entries changed
+// between the source trees oldDir (oldVersion) and newDir.
+func summarize(w io.Writer, oldDir, newDir string, oldVersion version.Version) error {
+	changes, err := debianChanges(oldDir, newDir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Changes in debian/ (%d files):\n", len(changes))
+	for _, change := range changes {
+		fmt.Fprintf(w, "  %s\n", change)
+	}
+
+	oldSeries, err := readSeries(oldDir)
+	if err != nil {
+		return err
+	}
+	newSeries, err := readSeries(newDir)
+	if err != nil {
+		return err
+	}
+	inOld := make(map[string]bool, len(oldSeries))
+	for _, patch := range oldSeries {
+		inOld[patch] = true
+	}
+	inNew := make(map[string]bool, len(newSeries))
+	for _, patch := range newSeries {
+		inNew[patch] = true
+	}
+	fmt.Fprintf(w, "\nPatches:\n")
+	for _, patch := range newSeries {
+		if !inOld[patch] {
+			fmt.Fprintf(w, "  added:   %s\n", patch)
+		}
+	}
+	for _, patch := range oldSeries {
+		if !inNew[patch] {
+			fmt.Fprintf(w, "  removed: %s\n", patch)
+		}
+	}
+
+	entries, err := changelogBetween(newDir, oldVersion)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nChangelog entries since %s (%d):\n\n", oldVersion, len(entries))
+	for _, entry := range entries {
+		writeChangelogEntry(w, entry)
+	}
+	return nil
+}
+
+// diffVersions makes available srcpkg in versions oldVersion and newVersion,
+// then writes a summary and a unified diff (mode “tree”) or debdiff(1) output
+// (mode “debdiff”) to w.
+func (i *invocation) diffVersions(w io.Writer, srcpkg, oldVersion, newVersion, mode string) error {
+	if mode != "tree" && mode != "debdiff" {
+		return fmt.Errorf("invalid -diff_mode %q: expected tree or debdiff", mode)
+	}
+	oldParsed, err := version.Parse(oldVersion)
+	if err != nil {
+		return err
+	}
+	oldDir, err := i.download(srcpkg, oldVersion)
+	if err != nil {
+		return err
+	}
+	newDir, err := i.download(srcpkg, newVersion)
+	if err != nil {
+		return err
+	}
+
+	var diff *exec.Cmd
+	if mode == "debdiff" {
+		oldDsc, err := dscName(srcpkg, oldVersion)
+		if err != nil {
+			return err
+		}
+		newDsc, err := dscName(srcpkg, newVersion)
+		if err != nil {
+			return err
+		}
+		name, err := i.lookPath("debdiff")
+		if err != nil {
+			return err
+		}
+		diff = exec.Command(name, oldDsc, newDsc)
+	} else {
+		if err := summarize(w, oldDir, newDir, oldParsed); err != nil {
+			return err
+		}
+		name, err := i.lookPath("diff")
+		if err != nil {
+			return err
+		}
+		diff = exec.Command(name, "-Nru", "-x", ".git", "-x", ".pc",
+			filepath.Base(oldDir),
+			filepath.Base(newDir))
+	}
+	diff.Dir = i.dest
+	diff.Stdout = w
+	diff.Stderr = os.Stderr
+	if err := diff.Run(); err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok && exiterr.ExitCode() == 1 {
+			return nil // exit status 1 means differences were found
+		}
+		return fmt.Errorf("%v: %v", diff.Args, err)
+	}
+	return nil
+}
+
+// diff implements -diff: args are <package> [<old version> <new version>].
+// Without versions, the installed version is compared against the candidate.
+func (i *invocation) diff(w io.Writer, args []string, mode string) error {
+	if len(args) != 1 && len(args) != 3 {
+		return fmt.Errorf("syntax: pk4 -diff <package> [<old version> <new version>]")
+	}
+	i.arg = args[0]
+	srcpkg, _, err := i.resolve()
+	if err != nil {
+		return err
+	}
+	if len(args) == 3 {
+		return i.diffVersions(w, srcpkg, args[1], args[2], mode)
+	}
+	installed, err := i.installedVersion(srcpkg)
+	if err != nil {
+		return err
+	}
+	candidate, err := i.candidateVersion(srcpkg)
+	if err != nil {
+		return err
+	}
+	if installed == candidate {
+		return fmt.Errorf("installed version of %s is the candidate version %s, please specify the versions to compare", srcpkg, candidate)
+	}
+	i.V().Printf("comparing installed version %s against candidate version %s", installed, candidate)
+	return i.diffVersions(w, srcpkg, installed, candidate, mode)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for path, contents := range files {
+		fn := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const oldChangelog = `hello (2.10-1) unstable; urgency=low
+
+  * New upstream release.
+
+ -- Santiago Vila <sanvila@debian.org>  Sun, 22 Mar 2015 11:48:01 +0100
+`
+	const newChangelog = `hello (2.10-2) unstable; urgency=medium
+
+  * Fix the build.
+
+ -- Santiago Vila <sanvila@debian.org>  Mon, 10 Jul 2017 10:12:32 +0200
+
+` + oldChangelog
+
+	oldDir := filepath.Join(tmp, "hello-2.10-1")
+	writeTree(t, oldDir, map[string]string{
+		"debian/changelog":      oldChangelog,
+		"debian/rules":          "#!/usr/bin/make -f\n",
+		"debian/patches/series": "old.patch\nkept.patch -p0\n",
+	})
+	newDir := filepath.Join(tmp, "hello-2.10-2")
+	writeTree(t, newDir, map[string]string{
+		"debian/changelog":      newChangelog,
+		"debian/rules":          "#!/usr/bin/make -f\n",
+		"debian/patches/series": "# comment\nkept.patch -p0\nnew.patch\n",
+	})
+
+	var buf bytes.Buffer
+	if err := summarize(&buf, oldDir, newDir, mustParseVersion("2.10-1")); err != nil {
+		t.Fatal(err)
+	}
+	want := `Changes in debian/ (2 files):
+  M debian/changelog
+  M debian/patches/series
+
+Patches:
+  added:   new.patch
+  removed: old.patch
+
+Changelog entries since 2.10-1 (1):
+
+hello (2.10-2) unstable; urgency=medium
+
+  * Fix the build.
+
+ -- Santiago Vila <sanvila@debian.org>  Mon, 10 Jul 2017 10:12:32 +0200
+
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected summary: got\n%s\nwant\n%s", got, want)
+	}
+}
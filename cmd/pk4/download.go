@@ -1,69 +1,55 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/Debian/pk4/internal/hooks"
 	"github.com/Debian/pk4/internal/humanbytes"
+	"github.com/Debian/pk4/internal/snapshot"
 	"github.com/Debian/pk4/internal/write"
 	"golang.org/x/sync/errgroup"
+	"pault.ag/go/debian/changelog"
 	"pault.ag/go/debian/control"
 )
 
-// downloadFile downloads uri to dest, falling back to snapshotBase when
-// encountering any status but HTTP 200.
-func (i *invocation) downloadFile(dest, snapshotBase, uri string) error {
+// downloadFile downloads uri to dest, falling back to the location provided by
+// b when the file is not available at uri (e.g. any status but HTTP 200).
+func (i *invocation) downloadFile(dest string, b backend, uri string) error {
 	if _, err := os.Stat(dest); err == nil {
 		return nil // file already exists
 	}
 	return write.Atomically(dest, func(w io.Writer) error {
 		// Try to download the file from the mirror first:
 		i.V().Printf("downloading %s", uri)
-		req, err := http.NewRequest("GET", uri, nil)
+		rc, err := i.fetch(uri)
 		if err != nil {
-			return err
-		}
-		req.Header.Set("User-Agent", "pk4")
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
-		}
-		if got, want := resp.StatusCode, http.StatusOK; got != want {
-			// Discard the Body (for Keep-Alive).
-			ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-			if snapshotBase == "" {
-				return fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+			if !unavailable(err) {
+				return err
 			}
-
-			u, _ := url.Parse(snapshotBase)
-			u.Path = path.Join(u.Path, strings.TrimPrefix(uri, i.mirrorUrl+"/"))
-			i.V().Printf("HTTP %d, falling back to %s", got, u.String())
-			req, err := http.NewRequest("GET", u.String(), nil)
-			if err != nil {
+			fallback := b.fallback(uri)
+			if fallback == "" {
 				return err
 			}
-			resp, err = http.DefaultClient.Do(req)
+
+			i.V().Printf("%v, falling back to %s", err, fallback)
+			rc, err = i.fetch(fallback)
 			if err != nil {
 				return err
 			}
-			if got, want := resp.StatusCode, http.StatusOK; got != want {
-				return fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
-			}
 		}
-		if _, err := io.Copy(w, resp.Body); err != nil {
+		defer rc.Close()
+		if _, err := io.Copy(w, rc); err != nil {
 			return err
 		}
 
@@ -71,97 +57,47 @@ func (i *invocation) downloadFile(dest, snapshotBase, uri string) error {
 	})
 }
 
-// downloadDSC downloads the .dsc file and all files referenced by it.
-func (i *invocation) downloadDSC(dest, snapshotBase, uri string) error {
+// downloadDSC downloads the .dsc file and all files referenced by it. It
+// returns the signer of the .dsc file, unless -allow_unauthenticated was
+// specified.
+func (i *invocation) downloadDSC(dest string, b backend, uri string) (signer string, _ error) {
 	dscPath := filepath.Join(filepath.Dir(dest), filepath.Base(uri))
-	if err := i.downloadFile(dscPath, snapshotBase, uri); err != nil {
-		return err
+	if err := i.downloadFile(dscPath, b, uri); err != nil {
+		return "", err
 	}
 	dsc, err := control.ParseDscFile(dscPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	var eg errgroup.Group
 	for _, f := range dsc.Files {
 		dest := filepath.Join(filepath.Dir(dest), f.Filename)
 		u, err := url.Parse(uri)
 		if err != nil {
-			return err
+			return "", err
 		}
 		u.Path = filepath.Join(filepath.Dir(u.Path), f.Filename)
-		eg.Go(func() error { return i.downloadFile(dest, snapshotBase, u.String()) })
+		eg.Go(func() error { return i.downloadFile(dest, b, u.String()) })
 	}
 	if err := eg.Wait(); err != nil {
-		return err
+		return "", err
 	}
-	if !i.allowUnauthenticated {
-		name, err := i.lookPath("dscverify")
-		if err != nil {
-			return err
-		}
-		dscverify := exec.Command(name, dscPath)
-		dscverify.Dir = filepath.Dir(dest)
-		dscverify.Stderr = os.Stderr
-		if err := dscverify.Run(); err != nil {
-			return fmt.Errorf("dscverify %s failed: %v", dscPath, err)
-		}
+	if i.allowUnauthenticated {
+		return "", nil
 	}
-	return nil
-}
-
-func (i *invocation) capDiskUsage(except string) error {
-	entries, err := ioutil.ReadDir(i.dest)
+	name, err := i.lookPath("dscverify")
 	if err != nil {
-		return err
-	}
-	// Sort ascendingly by creation time, i.e. the pk4 download time.
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].ModTime().Before(entries[j].ModTime())
-	})
-	var eg errgroup.Group
-	sums := make([]int64, len(entries))
-	for idx, entry := range entries {
-		idx, entry := idx, entry // copy
-		eg.Go(func() error {
-			var sum int64
-			subdir := filepath.Join(i.dest, entry.Name())
-			err := filepath.Walk(subdir, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				sum += info.Size()
-				return nil
-			})
-			sums[idx] = sum
-			return err
-		})
-	}
-	if err := eg.Wait(); err != nil {
-		return err
-	}
-	var sum int64
-	for _, subsum := range sums {
-		sum += subsum
-	}
-	i.V().Printf("pk4 destdir %s currently uses %s of disk space", i.dest, humanbytes.Format(sum))
-	deleted := false
-	for j := 0; sum > i.diskUsageLimit && j < len(entries); j++ {
-		if strings.HasPrefix(entries[j].Name(), except) {
-			continue // avoid deleting the package we are about to download/unpack
-		}
-		i.V().Printf("  deleting %s (%d bytes)", entries[j].Name(), sums[j])
-		if err := os.RemoveAll(filepath.Join(i.dest, entries[j].Name())); err != nil {
-			return err
-		}
-		sum -= sums[j]
-		deleted = true
+		return "", err
 	}
-	if deleted {
-		i.V().Printf("now using %s of disk space (limit: %s)", humanbytes.Format(sum), humanbytes.Format(i.diskUsageLimit))
-	} else {
-		i.V().Printf("already below the limit of %s", humanbytes.Format(i.diskUsageLimit))
+	var stdout, stderr bytes.Buffer
+	dscverify := exec.Command(name, dscPath)
+	dscverify.Dir = filepath.Dir(dest)
+	dscverify.Stdout = &stdout
+	dscverify.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := dscverify.Run(); err != nil {
+		return "", fmt.Errorf("dscverify %s failed: %v", dscPath, err)
 	}
-	return nil
+	return parseSigner(append(stdout.Bytes(), stderr.Bytes()...)), nil
 }
 
 func available(path string) (uint64, error) {
@@ -172,10 +108,74 @@ func available(path string) (uint64, error) {
 	return stat.Bavail * uint64(stat.Bsize), nil
 }
 
-// downloadDSCAndUnpack downloads the .dsc file fpath and unpacks it to dest.
-func (i *invocation) downloadDSCAndUnpack(dest, srcpkg, srcversion, snapshotBase, fpath string, totalSize int64) error {
-	i.V().Printf("downloading source package %s %s (%s)", srcpkg, srcversion, humanbytes.Format(totalSize))
+// checkSpace returns an error if -dest does not have required bytes of
+// available space to perform action (download or unpack) for src.
+func (i *invocation) checkSpace(src *sourceInfo, action string, required int64) error {
+	available, err := available(i.dest)
+	if err != nil {
+		return err
+	}
+	if uint64(required) < available {
+		return nil
+	}
+	return fmt.Errorf("not enough disk space to %s %s %s: need approximately %s, but only %s available in %s",
+		action,
+		src.srcpkg,
+		src.srcversion,
+		humanbytes.Format(required),
+		humanbytes.Format(int64(available)),
+		i.dest)
+}
+
+// sourceInfo describes a source package version and where pk4 obtained it.
+type sourceInfo struct {
+	srcpkg     string
+	srcversion string
+	outputDir  string
+
+	// stagedDir is the path underneath a staging directory (see stagingDir)
+	// into which the source is unpacked before it is renamed to outputDir.
+	stagedDir string
+
+	// origin is the archive from which the source was downloaded, e.g. Debian
+	// (the Origin of an archive in the index), snapshot.debian.org/debian or
+	// dgit.
+	origin string
+
+	// dscURL is the URL of the .dsc file, empty for the dgit backend.
+	dscURL string
+
+	// signer is the signer of the .dsc file as verified by dscverify(1).
+	signer string
+}
 
+// dscPath returns the local path of the .dsc file, if any.
+func (s sourceInfo) dscPath() string {
+	if s.dscURL == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(s.outputDir), path.Base(s.dscURL))
+}
+
+func (s sourceInfo) hookEnv() hooks.Env {
+	return hooks.Env{
+		Source:    s.srcpkg,
+		Version:   s.srcversion,
+		Dsc:       s.dscPath(),
+		OutputDir: s.outputDir,
+		Origin:    s.origin,
+	}
+}
+
+// downloadDSCAndUnpack downloads the .dsc file src.dscURL next to
+// src.outputDir and unpacks it to src.stagedDir. It fills in src.signer.
+func (i *invocation) downloadDSCAndUnpack(src *sourceInfo, b backend, totalSize int64) error {
+	dest := src.outputDir
+	i.V().Printf("downloading source package %s %s (%s)", src.srcpkg, src.srcversion, humanbytes.Format(totalSize))
+
+	// Until the files are downloaded, the unpacked size can only be
+	// extrapolated from the download size.
+	estimate := totalSize + int64(float64(totalSize)*i.unpackRatio(src.srcpkg))
 	available, err := available(i.dest)
 	if err != nil {
 		return err
@@ -185,20 +185,51 @@ func (i *invocation) downloadDSCAndUnpack(dest, srcpkg, srcversion, snapshotBase
 
 	if uint64(totalSize) >= available {
 		// download won’t succeed without prior cleanup
-		if err := i.capDiskUsage(srcpkg); err != nil {
+		if err := i.capDiskUsage(src.srcpkg, estimate); err != nil {
+			return err
+		}
+		if err := i.checkSpace(src, "download", totalSize); err != nil {
 			return err
 		}
 	} else {
-		eg.Go(func() error { return i.capDiskUsage(srcpkg) })
+		eg.Go(func() error { return i.capDiskUsage(src.srcpkg, estimate) })
 	}
 
-	eg.Go(func() error { return i.downloadDSC(dest, snapshotBase, fpath) })
+	eg.Go(func() error {
+		signer, err := i.downloadDSC(dest, b, src.dscURL)
+		src.signer = signer
+		return err
+	})
 
 	if err := eg.Wait(); err != nil {
 		return err
 	}
 
-	hooksFound, err := i.runHooks(filepath.Join(i.configDir, "hooks-enabled", "unpack"), filepath.Dir(dest), []string{filepath.Base(fpath), dest})
+	// Verify there is enough space before dpkg-source fails halfway through.
+	unpacked, err := i.estimateUnpackedSize(src.srcpkg, src.dscPath())
+	if err != nil {
+		return err
+	}
+	i.V().Printf("estimated unpacked size: %s", humanbytes.Format(unpacked))
+	if err := i.checkSpace(src, "unpack", unpacked); err != nil {
+		if err := i.capDiskUsage(src.srcpkg, unpacked); err != nil {
+			return err
+		}
+		if err := i.checkSpace(src, "unpack", unpacked); err != nil {
+			return err
+		}
+	}
+
+	return i.unpack(*src)
+}
+
+// unpack unpacks the downloaded .dsc file of src to src.stagedDir using the
+// unpack hooks, or dpkg-source -x if there are none.
+func (i *invocation) unpack(src sourceInfo) error {
+	dscBase := filepath.Base(src.dscPath())
+	env := src.hookEnv()
+	env.OutputDir = src.stagedDir
+	hooksFound, err := i.runHooks(hooks.Unpack, filepath.Dir(src.outputDir), env, dscBase, src.stagedDir)
 	if hooksFound {
 		return err
 	}
@@ -209,90 +240,213 @@ func (i *invocation) downloadDSCAndUnpack(dest, srcpkg, srcversion, snapshotBase
 	if err != nil {
 		return err
 	}
-	args := []string{"-x", filepath.Base(fpath), dest}
+	args := []string{"-x", dscBase, src.stagedDir}
 	if i.allowUnauthenticated {
 		args = append([]string{"--no-check"}, args...)
 	}
 
 	dpkgSource := exec.Command(name, args...)
-	dpkgSource.Dir = filepath.Dir(dest)
+	dpkgSource.Dir = filepath.Dir(src.outputDir)
 	dpkgSource.Stderr = os.Stderr
 	return dpkgSource.Run()
 }
 
-func (i *invocation) downloadSource(dest, srcpkg, srcversion string) error {
+func (i *invocation) snapshotClient() *snapshot.Client {
+	return &snapshot.Client{
+		BaseURL:    i.snapshotBase,
+		CacheDir:   filepath.Join(i.dest, ".snapshot"),
+		MaxAge:     24 * time.Hour,
+		MaxRetries: 3,
+	}
+}
+
+// downloadSource downloads src.srcpkg in src.srcversion and unpacks it to
+// src.stagedDir. It returns src with the origin and .dsc URL filled in.
+func (i *invocation) downloadSource(src sourceInfo) (sourceInfo, error) {
+	srcpkg, srcversion := src.srcpkg, src.srcversion
 	dsc, err := i.lookupDSC(srcpkg, srcversion)
 	if err == nil {
-		return i.downloadDSCAndUnpack(dest, srcpkg, srcversion, "", dsc.URL, dsc.Size)
+		i.V().Printf("found %s %s in archive (Origin %q, Label %q)", srcpkg, srcversion, dsc.Origin, dsc.Label)
+		b := i.backendFor(dsc.Origin, dsc.Label, srcpkg, srcversion)
+		src.origin = dsc.Origin
+		src.dscURL = dsc.URL
+		err := i.downloadDSCAndUnpack(&src, b, dsc.Size)
+		return src, err
 	}
 	if err != notFound && !os.IsNotExist(err) {
-		return err
+		return src, err
+	}
+	if i.offline {
+		return src, fmt.Errorf("%s %s not found in the pk4 index, and -offline forbids falling back to snapshot.debian.org. Add a file:// or copy:// mirror which contains the source package to your apt sources, run apt update, or re-run pk4 without -offline", srcpkg, srcversion)
 	}
 	// fallback to snapshot.debian.org lookup
 
-	// TODO(https://bugs.debian.org/740096): switch to https once available
-	u, _ := url.Parse(i.snapshotBase)
-	u.Path = "/mr/package/" + srcpkg + "/" + srcversion + "/srcfiles"
-	v := url.Values{}
-	v.Set("fileinfo", "1")
-	u.RawQuery = v.Encode()
-	req, err := http.NewRequest("GET", u.String(), nil)
+	srcfiles, err := i.snapshotClient().SrcFiles(srcpkg, srcversion)
 	if err != nil {
-		return err
-	}
-	req.Header.Set("User-Agent", "pk4")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+		return src, fmt.Errorf("%s %s: %v", srcpkg, srcversion, err)
 	}
-	if got, want := resp.StatusCode, http.StatusOK; got != want {
-		return fmt.Errorf("%q: unexpected HTTP status code: got %d, want %d", u.String(), got, want)
-	}
-	var srcfiles struct {
-		Fileinfo map[string][]struct {
-			Name        string `json:"name"`
-			ArchiveName string `json:"archive_name"`
-			Path        string `json:"path"`
-			FirstSeen   string `json:"first_seen"`
-			Size        int64  `json:"size"`
-		} `json:"fileinfo"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&srcfiles); err != nil {
-		return err
+
+	archives := make(map[string]bool, len(i.snapshotArchives))
+	for _, archive := range i.snapshotArchives {
+		archives[archive.name] = true
 	}
 
 	// sum up total size first
 	var totalSize int64
 	for _, infos := range srcfiles.Fileinfo {
 		for _, info := range infos {
-			if info.ArchiveName != "debian" {
+			if !archives[info.ArchiveName] {
 				continue // skip e.g. “debian-debug”
 			}
 			totalSize += info.Size
+			break // the same file can be in multiple archives
 		}
 	}
 
-	// download DSC
-	for _, infos := range srcfiles.Fileinfo {
-		for _, info := range infos {
-			if info.ArchiveName != "debian" {
-				continue // skip e.g. “debian-debug”
-			}
-			if !strings.HasSuffix(info.Name, ".dsc") {
-				continue
+	// download DSC from the first archive (in configured order) containing it
+	for _, archive := range i.snapshotArchives {
+		for _, infos := range srcfiles.Fileinfo {
+			for _, info := range infos {
+				if info.ArchiveName != archive.name {
+					continue
+				}
+				if !strings.HasSuffix(info.Name, ".dsc") {
+					continue
+				}
+				snapshotBase := i.snapshotClient().ArchiveURL(info.ArchiveName, info.FirstSeen)
+				i.V().Printf("found %s %s in snapshot.debian.org archive %s (first seen %s)", srcpkg, srcversion, info.ArchiveName, info.FirstSeen)
+				src.origin = "snapshot.debian.org/" + info.ArchiveName
+				mirror := i.archiveMirror(archive)
+				if mirror == "" {
+					src.dscURL = snapshotBase + path.Join(info.Path, info.Name)
+					err := i.downloadDSCAndUnpack(&src, noFallback{}, totalSize)
+					return src, err
+				}
+				b := snapshotBackend{snapshotBase: snapshotBase}
+				src.dscURL = mirror + path.Join(info.Path, info.Name)
+				err := i.downloadDSCAndUnpack(&src, b, totalSize)
+				return src, err
 			}
-			snapshotBase := i.snapshotBase + path.Join("archive", info.ArchiveName, info.FirstSeen)
-			fpath := i.mirrorUrl + path.Join(info.Path, info.Name)
-			return i.downloadDSCAndUnpack(dest, srcpkg, srcversion, snapshotBase, fpath, totalSize)
 		}
 	}
-	return fmt.Errorf("could not find .dsc file on snapshot.debian.org") // TODO
+	return src, fmt.Errorf("could not find .dsc file of %s %s in snapshot.debian.org archives %v", srcpkg, srcversion, i.snapshotArchiveNames())
+}
+
+func (i *invocation) snapshotArchiveNames() []string {
+	names := make([]string, len(i.snapshotArchives))
+	for idx, archive := range i.snapshotArchives {
+		names[idx] = archive.name
+	}
+	return names
+}
+
+// adoptOrRemove handles the source tree outputDir, which has no stamp. Source
+// trees unpacked by versions of pk4 which did not write stamps yet are adopted
+// by writing a stamp, provided their debian/changelog matches. Otherwise, the
+// source tree is incomplete (e.g. left behind by a failed dpkg-source -x) or
+// was modified, so it is only removed (to be unpacked again) with -force.
+func (i *invocation) adoptOrRemove(outputDir, srcpkg, srcversion string) (adopted bool, _ error) {
+	if latest, err := changelog.ParseFileOne(filepath.Join(outputDir, "debian", "changelog")); err == nil &&
+		latest.Source == srcpkg &&
+		latest.Version.String() == srcversion {
+		i.V().Printf("adopting %s, which was unpacked without %s", outputDir, filepath.Base(stampPath(outputDir)))
+		// Unpacked stays zero: when the source tree was unpacked is unknown,
+		// so it is kept as possibly modified (see modification).
+		return true, writeStamp(outputDir, &stamp{
+			Arg:      i.arg,
+			Source:   srcpkg,
+			Version:  srcversion,
+			LastUsed: time.Now().UTC(),
+		})
+	}
+	if !i.force {
+		// The source tree might have been unpacked by the user, or modified
+		// after unpacking (e.g. by dch -i), so never delete it implicitly.
+		modification, err := i.modification(&cacheEntry{
+			name: filepath.Base(outputDir),
+			tree: true,
+		})
+		if err != nil {
+			return false, err
+		}
+		if modification == "" {
+			modification = "unknown whether modified"
+		}
+		return false, fmt.Errorf("%s is incomplete (no %s and no matching debian/changelog), but might contain local modifications (%s). Move it out of the way, or use -force to unpack it again", outputDir, filepath.Base(stampPath(outputDir)), modification)
+	}
+	log.Printf("%s is incomplete (no %s), unpacking again (-force)", outputDir, filepath.Base(stampPath(outputDir)))
+	return false, os.RemoveAll(outputDir)
 }
 
 func (i *invocation) download(srcpkg, srcversion string) (outputDir string, _ error) {
+	outputDir, l, err := i.downloadShared(srcpkg, srcversion)
+	if err != nil {
+		return "", err
+	}
+	l.Close()
+	return outputDir, nil
+}
+
+// downloadShared is like download, but returns a shared lock on the source
+// tree, which prevents its eviction until the lock is closed (e.g. while a
+// shell is open in the source tree).
+func (i *invocation) downloadShared(srcpkg, srcversion string) (outputDir string, shared *os.File, _ error) {
+	name := lockName(srcpkg, srcversion)
+	// Complete source trees are made available under the shared lock only,
+	// so that pk4 does not wait for e.g. a shell open in the source tree.
+	l, err := i.lockShared(name)
+	if err != nil {
+		return "", nil, err
+	}
 	outputDir = filepath.Join(i.dest, srcpkg+"-"+srcversion) // per dpkg-source(1)
+	complete, err := recordUse(outputDir)
+	if err != nil {
+		l.Close()
+		return "", nil, err
+	}
+	if complete {
+		return outputDir, l, nil
+	}
+	l.Close()
 
-	// TODO(https://bugs.debian.org/877969): consider switching to dgit clone
+	// Concurrent downloads of the same version wait for each other, so that
+	// all but the first one find the complete source tree.
+	l, err = i.lock(name)
+	if err != nil {
+		return "", nil, err
+	}
+	outputDir, err = i.downloadLocked(srcpkg, srcversion)
+	if err == nil {
+		// Without releasing the lock in between, as the source tree could be
+		// evicted otherwise.
+		err = i.downgrade(l)
+	}
+	if err != nil {
+		l.Close()
+		return "", nil, err
+	}
+	return outputDir, l, nil
+}
+
+// recordUse records the access to the source tree outputDir for eviction (see
+// capDiskUsage). It returns false if outputDir has no stamp, i.e. does not
+// exist or is incomplete.
+func recordUse(outputDir string) (complete bool, _ error) {
+	st, err := readStamp(outputDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	st.LastUsed = time.Now().UTC()
+	return true, writeStamp(outputDir, st)
+}
+
+// downloadLocked makes available srcpkg in srcversion in -dest. The caller
+// must hold the lock lockName(srcpkg, srcversion).
+func (i *invocation) downloadLocked(srcpkg, srcversion string) (outputDir string, _ error) {
+	outputDir = filepath.Join(i.dest, srcpkg+"-"+srcversion) // per dpkg-source(1)
 
 	// We cannot use apt-get source because it fails when the package is no
 	// longer referenced by sources.list, i.e. when apt-cache policy <package>
@@ -301,18 +455,113 @@ func (i *invocation) download(srcpkg, srcversion string) (outputDir string, _ er
 
 	_, err := os.Stat(outputDir)
 	if err == nil {
-		return outputDir, nil // nothing to do
+		if complete, err := recordUse(outputDir); err != nil {
+			return "", err
+		} else if complete {
+			return outputDir, nil
+		}
+		adopted, err := i.adoptOrRemove(outputDir, srcpkg, srcversion)
+		if err != nil {
+			return "", err
+		}
+		if adopted {
+			return outputDir, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := i.cleanStaging(); err != nil {
+		return "", err
+	}
+
+	// Like write.Atomically for files, the source tree is assembled in a
+	// staging directory and only renamed into place once complete.
+	staging, err := i.stagingDir()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	downloaded := time.Now()
+	src := sourceInfo{
+		srcpkg:     srcpkg,
+		srcversion: srcversion,
+		outputDir:  outputDir,
+		stagedDir:  filepath.Join(staging, filepath.Base(outputDir)),
+	}
+	if _, err := i.runHooks(hooks.BeforeDownload, i.dest, src.hookEnv()); err != nil {
+		return "", err
+	}
+
+	cloned := false
+	if i.backend == "dgit" {
+		// See also https://bugs.debian.org/877969
+		cloned, err = i.dgitClone(src.stagedDir, srcpkg, srcversion)
+		if err != nil {
+			return "", err
+		}
+		src.origin = "dgit"
 	}
 
-	if !os.IsNotExist(err) {
+	if !cloned {
+		src, err = i.downloadSource(src)
+		if err != nil {
+			return "", err
+		}
+		if i.gitImport {
+			if err := i.gitImportTree(src.stagedDir, src.dscPath()); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err := os.Rename(src.stagedDir, outputDir); err != nil {
 		return "", err
 	}
 
-	if err := i.downloadSource(outputDir, srcpkg, srcversion); err != nil {
+	if _, err := i.runHooks(hooks.AfterUnpack, outputDir, src.hookEnv()); err != nil {
+		log.Printf("hook failure: %v", err)
+		// hooks are best-effort, don’t fail
+	}
+
+	st := &stamp{
+		Arg:        i.arg,
+		Source:     srcpkg,
+		Version:    srcversion,
+		Backend:    "dsc",
+		Origin:     src.origin,
+		DscURL:     src.dscURL,
+		Signer:     src.signer,
+		Downloaded: downloaded.UTC(),
+		Unpacked:   time.Now().UTC(),
+	}
+	st.LastUsed = st.Unpacked
+	if cloned {
+		st.Backend = "dgit"
+	} else {
+		if st.Sha256, err = dscChecksums(src.dscPath()); err != nil {
+			return "", err
+		}
+		for fn := range st.Sha256 {
+			fi, err := os.Stat(filepath.Join(i.dest, fn))
+			if err != nil {
+				return "", err
+			}
+			st.DownloadSize += fi.Size()
+		}
+	}
+	// The source tree was just written, so its blocks are likely cached.
+	st.SizeAt = time.Now().UTC()
+	st.Hardlinks = make(map[fileID]int64)
+	if st.Size, err = blockUsage(outputDir, st.Hardlinks); err != nil {
+		return "", err
+	}
+	if err := writeStamp(outputDir, st); err != nil {
 		return "", err
 	}
 
-	if _, err := i.runHooks(filepath.Join(i.configDir, "hooks-enabled", "after-download"), outputDir, nil); err != nil {
+	if _, err := i.runHooks(hooks.AfterDownload, outputDir, src.hookEnv()); err != nil {
 		log.Printf("hook failure: %v", err)
 		// hooks are best-effort, don’t fail
 	}
@@ -5,7 +5,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/Debian/pk4/internal/index"
@@ -13,13 +16,22 @@ import (
 
 const srcfilesResponse = `{"_comment": "foo", "version": "2.10-1", "result": [{"hash": "f7bebf6f9c62a2295e889f66e05ce9bfaed9ace3"}, {"hash": "58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58"}, {"hash": "baef5bf30c74a138561a4395794447b1a09d243f"}], "fileinfo": {"baef5bf30c74a138561a4395794447b1a09d243f": [{"name": "hello_2.10-1.debian.tar.xz", "archive_name": "debian", "path": "/pool/main/h/hello", "first_seen": "20150322T153011Z", "size": 6072}, {"name": "hello_2.10-1.debian.tar.xz", "archive_name": "debian-debug", "path": "/pool/main/h/hello", "first_seen": "20170315T030828Z", "size": 6072}], "f7bebf6f9c62a2295e889f66e05ce9bfaed9ace3": [{"name": "hello_2.10.orig.tar.gz", "archive_name": "debian", "path": "/pool/main/h/hello", "first_seen": "20150322T153011Z", "size": 725946}, {"name": "hello-traditional_2.10.orig.tar.gz", "archive_name": "debian", "path": "/pool/main/h/hello-traditional", "first_seen": "20150322T153011Z", "size": 725946}, {"name": "hello_2.10.orig.tar.gz", "archive_name": "debian-debug", "path": "/pool/main/h/hello", "first_seen": "20170315T030828Z", "size": 725946}, {"name": "hello_2.10.orig.tar.gz", "archive_name": "debian-security", "path": "/pool/updates/main/h/hello", "first_seen": "20170419T102349Z", "size": 725946}], "58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58": [{"name": "hello_2.10-1.dsc", "archive_name": "debian", "path": "/pool/main/h/hello", "first_seen": "20150322T153011Z", "size": 1323}, {"name": "hello_2.10-1.dsc", "archive_name": "debian-debug", "path": "/pool/main/h/hello", "first_seen": "20170315T030828Z", "size": 1323}]}, "package": "hello"}`
 
+// securityResponse is srcfilesResponse for a version which was only ever
+// published in the debian-security archive.
+const securityResponse = `{"_comment": "foo", "version": "2.10-1", "result": [{"hash": "f7bebf6f9c62a2295e889f66e05ce9bfaed9ace3"}, {"hash": "58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58"}, {"hash": "baef5bf30c74a138561a4395794447b1a09d243f"}], "fileinfo": {"baef5bf30c74a138561a4395794447b1a09d243f": [{"name": "hello_2.10-1.debian.tar.xz", "archive_name": "debian-security", "path": "/pool/updates/main/h/hello", "first_seen": "20170419T102349Z", "size": 6072}], "f7bebf6f9c62a2295e889f66e05ce9bfaed9ace3": [{"name": "hello_2.10.orig.tar.gz", "archive_name": "debian", "path": "/pool/main/h/hello", "first_seen": "20150322T153011Z", "size": 725946}, {"name": "hello_2.10.orig.tar.gz", "archive_name": "debian-security", "path": "/pool/updates/main/h/hello", "first_seen": "20170419T102349Z", "size": 725946}], "58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58": [{"name": "hello_2.10-1.dsc", "archive_name": "debian-security", "path": "/pool/updates/main/h/hello", "first_seen": "20170419T102349Z", "size": 1323}]}, "package": "hello"}`
+
 func TestDownload(t *testing.T) {
 	t.Parallel()
 
 	for _, entry := range []struct {
-		name     string
-		fallback bool
-		idx      index.URIs
+		name       string
+		fallback   bool
+		offline    bool
+		local      string // URI scheme prefix for serving testdata/Download
+		security   bool
+		incomplete bool // leave an incomplete tree (without stamp) behind
+		wantOrigin string
+		idx        index.URIs
 	}{
 		{
 			name:     "MirrorFromIndex",
@@ -36,13 +48,58 @@ func TestDownload(t *testing.T) {
 		},
 
 		{
-			name:     "MirrorFromSnapshot",
-			fallback: false,
+			name:       "MirrorFromSnapshot",
+			fallback:   false,
+			wantOrigin: "snapshot.debian.org/debian",
+		},
+
+		{
+			name:       "Snapshot",
+			fallback:   true,
+			wantOrigin: "snapshot.debian.org/debian",
+		},
+
+		{
+			name:       "SnapshotSecurity",
+			fallback:   true,
+			security:   true,
+			wantOrigin: "snapshot.debian.org/debian-security",
+		},
+
+		{
+			name:       "IncompleteTree",
+			fallback:   true,
+			incomplete: true,
+			wantOrigin: "snapshot.debian.org/debian",
+		},
+
+		{
+			name:    "OfflineLocalMirror",
+			offline: true,
+			local:   "file://",
+			idx: index.URIs{
+				index.Source{
+					Package: "hello",
+					Version: mustParseVersion("2.10-1"),
+				}: index.DSC{
+					URL:  "/hello_2.10-1.dsc",
+					Size: 733341,
+				},
+			},
 		},
 
 		{
-			name:     "Snapshot",
-			fallback: true,
+			name:  "AptMethod",
+			local: "fake:",
+			idx: index.URIs{
+				index.Source{
+					Package: "hello",
+					Version: mustParseVersion("2.10-1"),
+				}: index.DSC{
+					URL:  "/hello_2.10-1.dsc",
+					Size: 733341,
+				},
+			},
 		},
 	} {
 		entry := entry // copy
@@ -61,9 +118,17 @@ func TestDownload(t *testing.T) {
 					http.Error(w, "expected ?fileinfo=1", http.StatusBadRequest)
 					return
 				}
+				if entry.security {
+					w.Write([]byte(securityResponse))
+					return
+				}
 				w.Write([]byte(srcfilesResponse))
 			})
-			if entry.fallback {
+			if entry.security {
+				mux.Handle("/archive/debian-security/20170419T102349Z/pool/updates/main/h/hello/",
+					http.StripPrefix("/archive/debian-security/20170419T102349Z/pool/updates/main/h/hello/",
+						http.FileServer(http.Dir("testdata/Download"))))
+			} else if entry.fallback {
 				mux.Handle("/archive/debian/20150322T153011Z/pool/main/h/hello/",
 					http.StripPrefix("/archive/debian/20150322T153011Z/pool/main/h/hello/",
 						http.FileServer(http.Dir("testdata/Download"))))
@@ -76,8 +141,14 @@ func TestDownload(t *testing.T) {
 			defer ts.Close()
 
 			i := invocation{
-				snapshotBase:   ts.URL + "/",
-				mirrorUrl:      ts.URL + "/debian",
+				snapshotBase: ts.URL + "/",
+				mirrorUrl:    ts.URL + "/debian",
+				offline:      entry.offline,
+				snapshotArchives: []snapshotArchive{
+					{name: "debian"},
+					{name: "debian-security", mirror: ts.URL + "/debian-security"},
+				},
+				aptMethodsDir:  filepath.Join("..", "..", "internal", "aptmethod", "testdata"), // the fake method
 				verbose:        *verbose,
 				dest:           dest,
 				diskUsageLimit: 50 * 1024 * 1024, // 50 MB
@@ -88,8 +159,16 @@ func TestDownload(t *testing.T) {
 			}
 
 			if len(entry.idx) > 0 {
+				base := ts.URL
+				if entry.local != "" {
+					abs, err := filepath.Abs("testdata/Download")
+					if err != nil {
+						t.Fatal(err)
+					}
+					base = entry.local + abs
+				}
 				for key, dsc := range entry.idx {
-					dsc.URL = ts.URL + dsc.URL
+					dsc.URL = base + dsc.URL
 					entry.idx[key] = dsc
 				}
 				idx, err := os.Create(filepath.Join(dest, "uris.index"))
@@ -106,9 +185,193 @@ func TestDownload(t *testing.T) {
 				i.indexDir = dest
 			}
 
-			if _, err := i.download("hello", "2.10-1"); err != nil {
+			if entry.incomplete {
+				i.force = true // incomplete trees are never removed implicitly
+				writeTree(t, filepath.Join(dest, "hello-2.10-1"), map[string]string{
+					"leftover": "from a failed dpkg-source -x",
+				})
+			}
+
+			outputDir, l, err := i.downloadShared("hello", "2.10-1")
+			if err != nil {
 				t.Fatal(err)
 			}
+			defer l.Close()
+			// The lock must be kept (downgraded) after unpacking:
+			if _, err := i.tryLock(lockName("hello", "2.10-1")); err != errLocked {
+				t.Fatalf("tryLock after downloadShared: got err %v, want %v", err, errLocked)
+			}
+			if _, err := os.Stat(filepath.Join(outputDir, "leftover")); !os.IsNotExist(err) {
+				t.Fatalf("incomplete tree was not unpacked again: %v", err)
+			}
+			fis, err := ioutil.ReadDir(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fi := range fis {
+				if strings.HasPrefix(fi.Name(), stagingPrefix) {
+					t.Errorf("staging directory %s not cleaned up", fi.Name())
+				}
+			}
+			st, err := readStamp(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := st.Origin, entry.wantOrigin; got != want {
+				t.Errorf("unexpected stamp origin: got %q, want %q", got, want)
+			}
+			if got, want := st.Signer, "Santiago Vila <sanvila@debian.org>"; got != want {
+				t.Errorf("unexpected stamp signer: got %q, want %q", got, want)
+			}
+			if got, want := len(st.Sha256), 3; got != want {
+				t.Errorf("unexpected number of stamp checksums: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDownloadOfflineSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "-offline must not access the network", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	i := invocation{
+		snapshotBase:   ts.URL + "/",
+		offline:        true,
+		verbose:        *verbose,
+		dest:           dest,
+		indexDir:       dest,
+		diskUsageLimit: 50 * 1024 * 1024, // 50 MB
+	}
+	_, err = i.download("hello", "2.10-1")
+	if err == nil {
+		t.Fatalf("download unexpectedly succeeded in offline mode")
+	}
+	for _, want := range []string{"-offline", "file://", "copy://"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("download error %q does not mention %q", err, want)
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 0 {
+		t.Errorf("snapshot server received %d requests in offline mode, want 0", got)
+	}
+}
+
+func TestDownloadLegacyTree(t *testing.T) {
+	t.Parallel()
+
+	const changelog = `hello (2.10-1) unstable; urgency=low
+
+  * New upstream release.
+
+ -- Santiago Vila <sanvila@debian.org>  Sun, 22 Mar 2015 14:35:18 +0100
+`
+	patch := filepath.Join("debian", "patches", "debian-changes-2.10-1")
+
+	for _, entry := range []struct {
+		name    string
+		files   map[string]string
+		wantErr bool
+	}{
+		{
+			// Unpacked by a version of pk4 which did not write stamps yet:
+			name: "Adopt",
+			files: map[string]string{
+				"debian/changelog": changelog,
+				"src/hello.c":      "/* fixed */",
+				patch:              "--- a/src/hello.c\n+++ b/src/hello.c\n",
+			},
+		},
+
+		{
+			// Not recognizably modified, but the version was bumped (e.g. by
+			// dch -i), so the source tree cannot be adopted either:
+			name: "IncompleteChangelog",
+			files: map[string]string{
+				"debian/changelog": strings.Replace(changelog, "2.10-1", "2.10-1.1", 1),
+				"src/hello.c":      "/* fixed */",
+			},
+			wantErr: true,
+		},
+
+		{
+			name: "IncompleteModified",
+			files: map[string]string{
+				"src/hello.c": "/* fixed */",
+				patch:         "--- a/src/hello.c\n+++ b/src/hello.c\n",
+			},
+			wantErr: true,
+		},
+	} {
+		entry := entry // copy
+		t.Run(entry.name, func(t *testing.T) {
+			t.Parallel()
+
+			dest, err := ioutil.TempDir("", "pk4test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dest)
+
+			tree := filepath.Join(dest, "hello-2.10-1")
+			writeTree(t, tree, entry.files)
+
+			i := invocation{
+				snapshotBase:   "http://snapshot.invalid/",
+				offline:        true, // the source tree must not be unpacked again
+				verbose:        *verbose,
+				dest:           dest,
+				indexDir:       dest,
+				diskUsageLimit: 50 * 1024 * 1024, // 50 MB
+				lookPath:       exec.LookPath,
+			}
+			outputDir, err := i.download("hello", "2.10-1")
+			if entry.wantErr {
+				if err == nil {
+					t.Fatalf("download unexpectedly succeeded")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if outputDir != tree {
+				t.Fatalf("download: got %q, want %q", outputDir, tree)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(tree, "src", "hello.c"))
+			if err != nil {
+				t.Fatalf("locally modified source tree deleted: %v", err)
+			}
+			if got, want := string(b), "/* fixed */"; got != want {
+				t.Fatalf("src/hello.c: got %q, want %q", got, want)
+			}
+			if entry.wantErr {
+				return
+			}
+
+			st, err := readStamp(tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := st.Source, "hello"; got != want {
+				t.Errorf("unexpected stamp source: got %q, want %q", got, want)
+			}
+			// The adopted source tree must not be evicted either:
+			modification, err := i.modification(&cacheEntry{name: "hello-2.10-1", tree: true, stamp: st})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := modification, "dpkg-source --commit patch debian-changes-2.10-1"; got != want {
+				t.Errorf("modification = %q, want %q", got, want)
+			}
 		})
 	}
 }
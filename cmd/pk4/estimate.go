@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// defaultUnpackRatio is the assumed ratio of unpacked source tree size to
+// download size when neither the compression format nor previous unpacks of
+// the source package provide a better estimate.
+const defaultUnpackRatio = 5
+
+// unpackRatio returns the ratio of unpacked source tree size to download size
+// of the most recently unpacked version of srcpkg in -dest, or
+// defaultUnpackRatio.
+func (i *invocation) unpackRatio(srcpkg string) float64 {
+	// Versions of other source packages (e.g. linux-signed-amd64 for linux)
+	// match the glob, too, and are skipped below.
+	matches, err := filepath.Glob(filepath.Join(i.dest, srcpkg+"-*.pk4.json"))
+	if err != nil {
+		return defaultUnpackRatio
+	}
+	var latest *stamp
+	for _, match := range matches {
+		st, err := readStamp(strings.TrimSuffix(match, ".pk4.json"))
+		if err != nil {
+			continue
+		}
+		if st.Source != srcpkg || st.Size == 0 || st.DownloadSize == 0 {
+			continue
+		}
+		if latest == nil || st.Unpacked.After(latest.Unpacked) {
+			latest = st
+		}
+	}
+	if latest == nil {
+		return defaultUnpackRatio
+	}
+	return float64(latest.Size) / float64(latest.DownloadSize)
+}
+
+// minGzipRatio is the lowest plausible compression ratio of source tarballs.
+// Lower ratios implied by the gzip ISIZE field indicate that it wrapped.
+const minGzipRatio = 1.5
+
+// gzipSize returns the uncompressed size of the .gz file path, as recorded in
+// the ISIZE field of the gzip trailer (see RFC 1952).
+func gzipSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var isize [4]byte
+	if _, err := f.ReadAt(isize[:], fi.Size()-int64(len(isize))); err != nil {
+		return 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(isize[:]))
+	if float64(size) < minGzipRatio*float64(fi.Size()) {
+		// ISIZE is the size modulo 2^32, i.e. useless for files >= 4 GiB.
+		return 0, fmt.Errorf("%s: implausible gzip ISIZE %d for %d compressed bytes (more than 4 GiB uncompressed?)", path, size, fi.Size())
+	}
+	return size, nil
+}
+
+// xzSize returns the uncompressed size of the .xz file path, as recorded in
+// the xz index.
+func (i *invocation) xzSize(path string) (int64, error) {
+	name, err := i.lookPath("xz")
+	if err != nil {
+		return 0, err
+	}
+	var stdout bytes.Buffer
+	xz := exec.Command(name, "--robot", "--list", path)
+	xz.Stdout = &stdout
+	xz.Stderr = os.Stderr
+	if err := xz.Run(); err != nil {
+		return 0, fmt.Errorf("%v: %v", xz.Args, err)
+	}
+	// See “Robot mode” in xz(1): totals, streams, blocks, compressed,
+	// uncompressed, …
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 || fields[0] != "totals" {
+			continue
+		}
+		return strconv.ParseInt(fields[4], 0, 64)
+	}
+	return 0, fmt.Errorf("%v: no totals line in output", xz.Args)
+}
+
+// uncompressedSize returns the uncompressed size of the source package file
+// path, if the compression format records it.
+func (i *invocation) uncompressedSize(path string) (int64, error) {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return gzipSize(path)
+	case strings.HasSuffix(path, ".xz"):
+		return i.xzSize(path)
+	case strings.HasSuffix(path, ".tar"):
+		fi, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	// e.g. bzip2, which does not record the uncompressed size
+	return 0, fmt.Errorf("uncompressed size of %s unknown", filepath.Base(path))
+}
+
+// estimateUnpackedSize returns the estimated disk usage of the source tree
+// which dpkg-source will unpack from the downloaded .dsc file dscPath. Files
+// whose uncompressed size is unknown are extrapolated using unpackRatio.
+func (i *invocation) estimateUnpackedSize(srcpkg, dscPath string) (int64, error) {
+	dsc, err := control.ParseDscFile(dscPath)
+	if err != nil {
+		return 0, err
+	}
+	ratio := i.unpackRatio(srcpkg)
+	var sum int64
+	for _, f := range dsc.Files {
+		if strings.HasSuffix(f.Filename, ".asc") {
+			continue // upstream signature
+		}
+		size, err := i.uncompressedSize(filepath.Join(filepath.Dir(dscPath), f.Filename))
+		if err != nil {
+			i.V().Printf("%v, assuming %.1f times the download size", err, ratio)
+			size = int64(float64(f.Size) * ratio)
+		}
+		sum += size
+	}
+	return sum, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEstimateUnpackedSize(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(bytes.Repeat([]byte{'x'}, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	orig := buf.Bytes()
+	debian := bytes.Repeat([]byte{'y'}, 1000) // pretend bzip2
+	dsc := fmt.Sprintf(`Format: 3.0 (quilt)
+Source: hello
+Version: 2.10-1
+Files:
+ 00000000000000000000000000000000 %d hello_2.10.orig.tar.gz
+ 00000000000000000000000000000000 %d hello_2.10-1.debian.tar.bz2
+`, len(orig), len(debian))
+	writeTree(t, dest, map[string]string{
+		"hello_2.10-1.dsc":            dsc,
+		"hello_2.10.orig.tar.gz":      string(orig),
+		"hello_2.10-1.debian.tar.bz2": string(debian),
+	})
+
+	i := invocation{dest: dest}
+	if got, want := i.unpackRatio("hello"), float64(defaultUnpackRatio); got != want {
+		t.Errorf("unpackRatio without previous unpacks: got %v, want %v", got, want)
+	}
+	dscPath := filepath.Join(dest, "hello_2.10-1.dsc")
+	got, err := i.estimateUnpackedSize("hello", dscPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(100000 + defaultUnpackRatio*1000); got != want {
+		t.Errorf("estimateUnpackedSize: got %d, want %d", got, want)
+	}
+
+	// A previous unpack of hello records the ratio, one of hello-tools
+	// (which shares the prefix) must be ignored:
+	writeCache(t, dest, []*stamp{
+		{Source: "hello", Version: "2.9-1", Size: 30000, DownloadSize: 1000},
+		{Source: "hello-tools", Version: "1.0-1", Size: 70000, DownloadSize: 1000},
+	})
+	if got, want := i.unpackRatio("hello"), 30.0; got != want {
+		t.Errorf("unpackRatio: got %v, want %v", got, want)
+	}
+	got, err = i.estimateUnpackedSize("hello", dscPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(100000 + 30*1000); got != want {
+		t.Errorf("estimateUnpackedSize: got %d, want %d", got, want)
+	}
+}
+
+func TestGzipSizeWrapped(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(bytes.Repeat([]byte{'x'}, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dest, "hello_2.10.orig.tar.gz")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := gzipSize(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(100000); got != want {
+		t.Errorf("gzipSize: got %d, want %d", got, want)
+	}
+
+	// Pretend the file was 4 GiB larger: ISIZE wraps around and implies a
+	// compression ratio barely above 1.
+	wrapped := buf.Bytes()
+	binary.LittleEndian.PutUint32(wrapped[len(wrapped)-4:], uint32(len(wrapped)+10))
+	if err := ioutil.WriteFile(path, wrapped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := gzipSize(path); err == nil {
+		t.Errorf("gzipSize with wrapped ISIZE: got %d, want an error", got)
+	}
+}
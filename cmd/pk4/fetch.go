@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/Debian/pk4/internal/aptmethod"
+)
+
+// httpStatusError is returned by fetch when the server responded with any
+// status but HTTP 200.
+type httpStatusError struct {
+	got int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status code: got %d, want %d", e.got, http.StatusOK)
+}
+
+// offlineError is returned by fetch when uri could only be fetched using the
+// network, but -offline was specified.
+type offlineError struct {
+	uri string
+}
+
+func (e *offlineError) Error() string {
+	return fmt.Sprintf("%s is not available locally and -offline forbids network access. Add a file:// or copy:// mirror which contains the source package to your apt sources, run apt update, or re-run pk4 without -offline", e.uri)
+}
+
+// unavailable returns whether err signals that the requested file does not
+// exist at its location, i.e. whether trying a fallback location makes sense.
+func unavailable(err error) bool {
+	if _, ok := err.(*httpStatusError); ok {
+		return true
+	}
+	if fe, ok := err.(*aptmethod.FailureError); ok {
+		return fe.NotFound()
+	}
+	return os.IsNotExist(err)
+}
+
+// aptMethod is a running apt acquire method, which is shared by all fetches of
+// its URI scheme.
+type aptMethod struct {
+	sync.Mutex // methods process one request at a time
+	m          *aptmethod.Method
+}
+
+// readAptConfig returns the current apt configuration (see apt-config(8)),
+// which is read once per invocation. The caller must hold i.methodsMu.
+func (i *invocation) readAptConfig() ([]string, error) {
+	if i.aptConfigRead {
+		return i.aptConfig, nil
+	}
+	name, err := i.lookPath("apt-config")
+	if err != nil {
+		i.aptConfigRead = true // no configuration to send
+		return nil, nil
+	}
+	dump := exec.Command(name, "dump")
+	dump.Stderr = os.Stderr
+	stdout, err := dump.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := dump.Start(); err != nil {
+		return nil, err
+	}
+	config, err := aptmethod.ParseConfig(stdout)
+	if err != nil {
+		return nil, err
+	}
+	if err := dump.Wait(); err != nil {
+		return nil, fmt.Errorf("apt-config dump: %v", err)
+	}
+	i.aptConfig = config
+	i.aptConfigRead = true
+	return config, nil
+}
+
+// startedMethod returns the running apt acquire method at path, starting it if
+// necessary.
+func (i *invocation) startedMethod(path string) (*aptMethod, error) {
+	i.methodsMu.Lock()
+	defer i.methodsMu.Unlock()
+	if am, ok := i.methods[path]; ok {
+		return am, nil
+	}
+	config, err := i.readAptConfig()
+	if err != nil {
+		return nil, err
+	}
+	m, err := aptmethod.Start(path, config)
+	if err != nil {
+		return nil, err
+	}
+	if i.methods == nil {
+		i.methods = make(map[string]*aptMethod)
+	}
+	am := &aptMethod{m: m}
+	i.methods[path] = am
+	return am, nil
+}
+
+// stopMethod terminates the apt acquire method at path, e.g. after a protocol
+// error left it in an unknown state.
+func (i *invocation) stopMethod(path string, am *aptMethod) error {
+	i.methodsMu.Lock()
+	defer i.methodsMu.Unlock()
+	if i.methods[path] == am {
+		delete(i.methods, path)
+	}
+	if err := am.m.Close(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// closeMethods terminates all running apt acquire methods.
+func (i *invocation) closeMethods() {
+	i.methodsMu.Lock()
+	defer i.methodsMu.Unlock()
+	for path, am := range i.methods {
+		if err := am.m.Close(); err != nil {
+			i.V().Printf("%s: %v", path, err)
+		}
+		delete(i.methods, path)
+	}
+}
+
+// fetchViaMethod downloads uri using the apt acquire method for its scheme,
+// configured with the current apt configuration (see apt-config(8)).
+func (i *invocation) fetchViaMethod(uri, scheme string) (io.ReadCloser, error) {
+	path := filepath.Join(i.aptMethodsDir, scheme)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: no apt method for URI scheme %q found in %s (is the corresponding apt-transport package installed?)", uri, scheme, i.aptMethodsDir)
+		}
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "pk4-method-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	// The contents remain readable via the returned *os.File until it is
+	// closed.
+	defer os.Remove(f.Name())
+	am, err := i.startedMethod(path)
+	if err != nil {
+		return nil, err
+	}
+	i.V().Printf("fetching %s via apt method %s", uri, path)
+	am.Lock()
+	err = am.m.Fetch(uri, f.Name())
+	am.Unlock()
+	if err != nil {
+		if _, ok := err.(*aptmethod.FailureError); !ok {
+			// The method might be in the middle of a request.
+			i.stopMethod(path, am)
+		}
+		return nil, err
+	}
+	// Open the file by name: the method might have replaced it.
+	return os.Open(f.Name())
+}
+
+// fetch returns the contents of uri. Like apt, pk4 understands http://,
+// https://, file:// and copy:// URIs. Plain paths refer to local files, too.
+// All other URI schemes (and all remote URIs if -apt_methods is specified) are
+// fetched using apt’s acquire methods.
+func (i *invocation) fetch(uri string) (io.ReadCloser, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file", "copy":
+		return os.Open(u.Path)
+	}
+
+	if i.offline {
+		return nil, &offlineError{uri: uri}
+	}
+	if i.aptMethods {
+		return i.fetchViaMethod(uri, u.Scheme)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "pk4")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			// Discard the Body (for Keep-Alive).
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, &httpStatusError{got: got}
+		}
+		return resp.Body, nil
+
+	default:
+		return i.fetchViaMethod(uri, u.Scheme)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchViaMethodReuse(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4-fetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// apt-config records each invocation, so that the test can verify the
+	// configuration is only dumped once.
+	calls := filepath.Join(tmp, "calls")
+	aptConfig := filepath.Join(tmp, "apt-config")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\necho 'Test::Enabled \"true\";'\n"
+	if err := ioutil.WriteFile(aptConfig, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, name := range []string{"a.dsc", "b.tar.xz", "c.tar.xz"} {
+		path := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	i := &invocation{
+		aptMethodsDir: filepath.Join("..", "..", "internal", "aptmethod", "testdata"), // the fake method
+		verbose:       *verbose,
+		lookPath: func(file string) (string, error) {
+			return filepath.Join(tmp, file), nil
+		},
+	}
+	defer i.closeMethods()
+
+	for _, path := range paths {
+		rc, err := i.fetchViaMethod("fake:"+path, "fake")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), filepath.Base(path); got != want {
+			t.Errorf("fake:%s: unexpected contents: got %q, want %q", path, got, want)
+		}
+	}
+
+	// A failed fetch must not terminate the method.
+	if _, err := i.fetchViaMethod("fake:"+filepath.Join(tmp, "missing"), "fake"); err == nil {
+		t.Errorf("fetching a missing file unexpectedly succeeded")
+	}
+	if _, err := i.fetchViaMethod("fake:"+paths[0], "fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(i.methods), 1; got != want {
+		t.Errorf("unexpected number of running methods: got %d, want %d", got, want)
+	}
+	b, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(b), "\n"), 1; got != want {
+		t.Errorf("apt-config unexpectedly called %d times, want %d: %q", got, want, b)
+	}
+	if !bytes.HasPrefix(b, []byte("dump")) {
+		t.Errorf("apt-config called with unexpected arguments: %q", b)
+	}
+
+	i.closeMethods()
+	if got, want := len(i.methods), 0; got != want {
+		t.Errorf("closeMethods left %d methods running", got)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"pault.ag/go/debian/changelog"
+)
+
+// patchTrailer is the git commit trailer which records the name of the quilt
+// patch a commit on the patches-applied branch corresponds to.
+const patchTrailer = "Pk4-Patch"
+
+// gitOutput is like git, but returns the standard output of git.
+func (i *invocation) gitOutput(dir string, args ...string) ([]byte, error) {
+	name, err := i.lookPath("git")
+	if err != nil {
+		return nil, err
+	}
+	git := exec.Command(name, append([]string{"-C", dir}, args...)...)
+	git.Stderr = os.Stderr
+	out, err := git.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", git.Args, err)
+	}
+	return out, nil
+}
+
+// patchHeaderEnd matches the first line of the diff part of a patch.
+var patchHeaderEnd = regexp.MustCompile(`^(--- |\+\+\+ |diff |Index: |=====)`)
+
+// patchMessage returns a git commit message for the quilt patch name with
+// contents b: the subject is taken from the DEP-3 Subject or Description
+// field, the body is the entire patch header.
+func patchMessage(name string, b []byte) string {
+	var header []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if patchHeaderEnd.MatchString(line) {
+			break
+		}
+		header = append(header, line)
+	}
+	var subject string
+	for _, line := range header {
+		for _, field := range []string{"Subject:", "Description:"} {
+			if subject == "" && strings.HasPrefix(line, field) {
+				subject = strings.TrimSpace(strings.TrimPrefix(line, field))
+			}
+		}
+	}
+	body := strings.TrimSpace(strings.Join(header, "\n"))
+	if subject == "" {
+		subject = name
+		if body != "" {
+			subject = strings.SplitN(body, "\n", 2)[0]
+		}
+	}
+	msg := subject + "\n\n"
+	if body != "" && body != subject {
+		msg += body + "\n\n"
+	}
+	return msg + patchTrailer + ": " + name + "\n"
+}
+
+// gitImportTree turns the source tree dir, unpacked from the .dsc file
+// dscPath, into a git repository with three branches: upstream
+// (the upstream sources, i.e. the tree without debian/ and without any patches
+// applied), debian (upstream plus the packaging) and patches-applied (debian
+// plus one commit per quilt patch), which is checked out.
+func (i *invocation) gitImportTree(dir, dscPath string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		i.V().Printf("%s already is a git repository (unpack hook?), not importing", dir)
+		return nil
+	}
+	entry, err := changelog.ParseFileOne(filepath.Join(dir, "debian", "changelog"))
+	if err != nil {
+		return err
+	}
+
+	// Commits are created from a pristine copy of the source package, so that
+	// patches can be applied one by one. The resulting tree is identical to
+	// dir, in which dpkg-source already applied all patches.
+	tmp, err := i.stagingDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	pristine := filepath.Join(tmp, "src")
+	dpkgSourceName, err := i.lookPath("dpkg-source")
+	if err != nil {
+		return err
+	}
+	args := []string{"--skip-patches", "-x", dscPath, pristine}
+	if i.allowUnauthenticated {
+		args = append([]string{"--no-check"}, args...)
+	}
+	dpkgSource := exec.Command(dpkgSourceName, args...)
+	dpkgSource.Dir = tmp
+	dpkgSource.Stderr = os.Stderr
+	if i.verbose {
+		dpkgSource.Stdout = os.Stderr
+	}
+	if err := dpkgSource.Run(); err != nil {
+		return fmt.Errorf("%v: %v", dpkgSource.Args, err)
+	}
+
+	if err := i.git(dir, "init", "--quiet"); err != nil {
+		return err
+	}
+	// dpkg-source keeps track of applied patches in .pc/
+	if err := ioutil.WriteFile(filepath.Join(dir, ".git", "info", "exclude"), []byte(".pc/\n"), 0644); err != nil {
+		return err
+	}
+	git := func(args ...string) error {
+		return i.git(dir, append([]string{"--work-tree", pristine}, args...)...)
+	}
+	commit := func(msg string) error {
+		return git("commit", "--quiet", "--allow-empty",
+			"--author", entry.ChangedBy,
+			"--date", entry.When.Format("Mon, 02 Jan 2006 15:04:05 -0700"),
+			"-m", msg)
+	}
+
+	if err := git("symbolic-ref", "HEAD", "refs/heads/upstream"); err != nil {
+		return err
+	}
+	if err := git("add", "--all", "--", ".", ":(exclude)debian"); err != nil {
+		return err
+	}
+	if err := commit(fmt.Sprintf("Import upstream version %s", entry.Version.Version)); err != nil {
+		return err
+	}
+
+	if err := git("checkout", "--quiet", "-b", "debian"); err != nil {
+		return err
+	}
+	if err := git("add", "--all", "--", "debian"); err != nil {
+		return err
+	}
+	if err := commit(fmt.Sprintf("Import Debian packaging %s %s", entry.Source, entry.Version)); err != nil {
+		return err
+	}
+
+	if err := git("checkout", "--quiet", "-b", "patches-applied"); err != nil {
+		return err
+	}
+	var series []seriesEntry
+	format, err := ioutil.ReadFile(filepath.Join(pristine, "debian", "source", "format"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Only dpkg-source applies patches for the 3.0 (quilt) format; in other
+	// formats, patches are applied at build time.
+	if strings.TrimSpace(string(format)) == "3.0 (quilt)" {
+		if series, err = readSeriesEntries(pristine); err != nil {
+			return err
+		}
+	}
+	patchBin, err := i.lookPath("patch")
+	if err != nil && len(series) > 0 {
+		return err
+	}
+	for _, s := range series {
+		patchPath := filepath.Join(pristine, "debian", "patches", s.name)
+		b, err := ioutil.ReadFile(patchPath)
+		if err != nil {
+			return err
+		}
+		i.V().Printf("applying patch %s", s.name)
+		// Same options as dpkg-source(1) uses for applying quilt patches.
+		patch := exec.Command(patchBin, "-s", "-t", "-F", "0", "-N", "-u", "-V", "never", "-E", "-p"+s.strip, "-i", patchPath)
+		patch.Dir = pristine
+		patch.Stdout = os.Stderr
+		patch.Stderr = os.Stderr
+		if err := patch.Run(); err != nil {
+			return fmt.Errorf("applying patch %s: %v: %v", s.name, patch.Args, err)
+		}
+		if err := git("add", "--all"); err != nil {
+			return err
+		}
+		if err := commit(patchMessage(s.name, b)); err != nil {
+			return err
+		}
+	}
+
+	// Update the index to refer to dir instead of the pristine copy.
+	return i.git(dir, "reset", "--quiet")
+}
+
+// slugRe matches runs of characters which git format-patch replaces in
+// patch file names.
+var slugRe = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+
+// patchName returns the quilt patch name for the commit message msg: the
+// value of the Pk4-Patch trailer if present (i.e. the commit was created by
+// gitImportTree), a name derived from the subject otherwise.
+func patchName(msg string) string {
+	lines := strings.Split(strings.TrimSpace(msg), "\n")
+	for n := len(lines) - 1; n >= 0; n-- {
+		line := lines[n]
+		if strings.TrimSpace(line) == "" {
+			break // trailers are in the last paragraph
+		}
+		if strings.HasPrefix(line, patchTrailer+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, patchTrailer+":"))
+		}
+	}
+	slug := strings.Trim(slugRe.ReplaceAllString(lines[0], "-"), "-.")
+	if len(slug) > 52 {
+		slug = strings.TrimRight(slug[:52], "-.")
+	}
+	return slug + ".patch"
+}
+
+// exportPatches implements -export_patches: it regenerates debian/patches from
+// the commits on top of the debian branch in the git repository dir, i.e. the
+// patches-applied branch created by gitImportTree.
+func (i *invocation) exportPatches(w io.Writer, dir string) error {
+	out, err := i.gitOutput(dir, "rev-list", "--reverse", "debian..HEAD")
+	if err != nil {
+		return err
+	}
+	commits := strings.Fields(string(out))
+	patchesDir := filepath.Join(dir, "debian", "patches")
+	old, err := readSeries(dir)
+	if err != nil {
+		return err
+	}
+
+	var series []string
+	written := make(map[string]bool)
+	for _, commit := range commits {
+		msg, err := i.gitOutput(dir, "log", "-1", "--format=%B", commit)
+		if err != nil {
+			return err
+		}
+		name := patchName(string(msg))
+		if written[name] {
+			return fmt.Errorf("commit %s: duplicate patch name %q", commit, name)
+		}
+		// Changes to debian/ belong onto the debian branch, not into patches.
+		patch, err := i.gitOutput(dir, "format-patch", "--stdout", "--no-signature", "--zero-commit", "-N",
+			commit+"^.."+commit, "--", ".", ":(exclude)debian")
+		if err != nil {
+			return err
+		}
+		if len(patch) == 0 {
+			i.V().Printf("commit %s only modifies debian/, skipping", commit)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(patchesDir, name)), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(patchesDir, name), patch, 0644); err != nil {
+			return err
+		}
+		written[name] = true
+		series = append(series, name)
+		fmt.Fprintf(w, "debian/patches/%s\n", name)
+	}
+
+	for _, name := range old {
+		if written[name] {
+			continue
+		}
+		i.V().Printf("removing patch %s, which is no longer in the patch queue", name)
+		if err := os.Remove(filepath.Join(patchesDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if len(series) == 0 {
+		if err := os.Remove(filepath.Join(patchesDir, "series")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(patchesDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(patchesDir, "series"), []byte(strings.Join(series, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatchName(t *testing.T) {
+	t.Parallel()
+
+	for _, entry := range []struct {
+		msg  string
+		want string
+	}{
+		{
+			msg:  "Fix the build\n\nDescription: Fix the build\n\nPk4-Patch: fix-build.patch\n",
+			want: "fix-build.patch",
+		},
+
+		{
+			msg:  "Use /usr/share, not /usr/local/share\n",
+			want: "Use-usr-share-not-usr-local-share.patch",
+		},
+	} {
+		if got := patchName(entry.msg); got != entry.want {
+			t.Errorf("patchName(%q) = %q, want %q", entry.msg, got, entry.want)
+		}
+	}
+}
+
+func TestPatchMessage(t *testing.T) {
+	t.Parallel()
+
+	const patch = `Description: Greet the world
+Author: Jane Doe <jane@example.net>
+--- a/hello.c
++++ b/hello.c
+`
+	got := patchMessage("greet.patch", []byte(patch))
+	want := `Greet the world
+
+Description: Greet the world
+Author: Jane Doe <jane@example.net>
+
+Pk4-Patch: greet.patch
+`
+	if got != want {
+		t.Fatalf("unexpected commit message: got %q, want %q", got, want)
+	}
+}
+
+const gitImportChangelog = `hello (1.0-1) unstable; urgency=medium
+
+  * Initial release.
+
+ -- Jane Doe <jane@example.net>  Mon, 10 Jul 2017 10:12:32 +0200
+`
+
+const gitImportControl = `Source: hello
+Maintainer: Jane Doe <jane@example.net>
+
+Package: hello
+Architecture: any
+Description: greeting
+ greeting
+`
+
+const gitImportPatch = `Description: Greet the world
+--- a/hello.c
++++ b/hello.c
+@@ -1 +1 @@
+-hello
++hello world
+`
+
+// setGitIdentity sets a git author and committer identity via environment
+// variables, so that tests do not depend on the user’s git configuration. It
+// returns a func to restore the environment.
+func setGitIdentity() func() {
+	var restore []func()
+	for key, val := range map[string]string{
+		"GIT_AUTHOR_NAME":     "pk4 test",
+		"GIT_AUTHOR_EMAIL":    "pk4@example.net",
+		"GIT_COMMITTER_NAME":  "pk4 test",
+		"GIT_COMMITTER_EMAIL": "pk4@example.net",
+		"GIT_CONFIG_NOSYSTEM": "1",
+	} {
+		key := key // copy
+		old, ok := os.LookupEnv(key)
+		os.Setenv(key, val)
+		restore = append(restore, func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+	return func() {
+		for _, fn := range restore {
+			fn()
+		}
+	}
+}
+
+func TestGitImport(t *testing.T) {
+	for _, tool := range []string{"dpkg-source", "git", "patch"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+	}
+	defer setGitIdentity()()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	// Build a 3.0 (quilt) source package with one patch.
+	build := filepath.Join(dest, "build")
+	writeTree(t, filepath.Join(build, "hello-1.0"), map[string]string{
+		"hello.c": "hello\n",
+	})
+	run := func(dir, name string, args ...string) []byte {
+		t.Helper()
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+		return out
+	}
+	run(build, "tar", "czf", "hello_1.0.orig.tar.gz", "hello-1.0")
+	writeTree(t, filepath.Join(build, "hello-1.0"), map[string]string{
+		"debian/changelog":           gitImportChangelog,
+		"debian/control":             gitImportControl,
+		"debian/source/format":       "3.0 (quilt)\n",
+		"debian/patches/series":      "greet.patch\n",
+		"debian/patches/greet.patch": gitImportPatch,
+	})
+	run(build, "dpkg-source", "-b", "hello-1.0")
+	for _, fn := range []string{"hello_1.0.orig.tar.gz", "hello_1.0-1.debian.tar.xz", "hello_1.0-1.dsc"} {
+		if err := os.Rename(filepath.Join(build, fn), filepath.Join(dest, fn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outputDir := filepath.Join(dest, "hello-1.0-1")
+	run(dest, "dpkg-source", "--no-check", "-x", "hello_1.0-1.dsc", outputDir)
+
+	i := invocation{
+		verbose:              *verbose,
+		dest:                 dest,
+		allowUnauthenticated: true,
+		lookPath:             exec.LookPath,
+	}
+	if err := i.gitImportTree(outputDir, filepath.Join(dest, "hello_1.0-1.dsc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.TrimSpace(string(run(outputDir, "git", "rev-parse", "--abbrev-ref", "HEAD"))), "patches-applied"; got != want {
+		t.Fatalf("unexpected branch checked out: got %q, want %q", got, want)
+	}
+	if got := run(outputDir, "git", "status", "--porcelain"); len(got) > 0 {
+		t.Fatalf("git status not clean after import:\n%s", got)
+	}
+	if got, want := string(run(outputDir, "git", "show", "upstream:hello.c")), "hello\n"; got != want {
+		t.Fatalf("unexpected upstream hello.c: got %q, want %q", got, want)
+	}
+	if got := run(outputDir, "git", "ls-tree", "upstream", "debian"); len(got) > 0 {
+		t.Fatalf("upstream branch unexpectedly contains debian/: %s", got)
+	}
+	if got, want := strings.TrimSpace(string(run(outputDir, "git", "log", "--format=%s", "debian..patches-applied"))), "Greet the world"; got != want {
+		t.Fatalf("unexpected patch queue: got %q, want %q", got, want)
+	}
+
+	// Add a patch using git, then export the patch queue.
+	writeTree(t, outputDir, map[string]string{
+		"README": "greetings\n",
+	})
+	run(outputDir, "git", "add", "README")
+	run(outputDir, "git", "commit", "--quiet", "--author", "Jane Doe <jane@example.net>", "-m", "Add a README")
+
+	var buf bytes.Buffer
+	if err := i.exportPatches(&buf, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "debian/patches/greet.patch\ndebian/patches/Add-a-README.patch\n"; got != want {
+		t.Fatalf("unexpected exportPatches output: got %q, want %q", got, want)
+	}
+	series, err := readSeries(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(series, " "), "greet.patch Add-a-README.patch"; got != want {
+		t.Fatalf("unexpected series: got %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(outputDir, "debian", "patches", "Add-a-README.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "+greetings") {
+		t.Fatalf("exported patch does not contain the README change:\n%s", b)
+	}
+}
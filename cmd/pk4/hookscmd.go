@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/Debian/pk4/internal/hooks"
+)
+
+// availableHooks returns the hooks shipped with pk4 and the hooks in the
+// user’s hooks-available directory.
+func (i *invocation) availableHooks() ([]hooks.Hook, error) {
+	return hooks.Available(i.systemHooksDir, filepath.Join(i.configDir, "hooks-available"))
+}
+
+// listHooks prints all available and enabled hooks per hook point.
+func (i *invocation) listHooks(w io.Writer) error {
+	available, err := i.availableHooks()
+	if err != nil {
+		return err
+	}
+	enabled, err := i.hooksRunner().Enabled()
+	if err != nil {
+		return err
+	}
+	isEnabled := make(map[string]bool, len(enabled))
+	for _, h := range enabled {
+		isEnabled[h.Point+"/"+h.Name] = true
+	}
+	isAvailable := make(map[string]bool, len(available))
+	for _, h := range available {
+		isAvailable[h.Point+"/"+h.Name] = true
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "HOOK\tSTATUS\tPATH\n")
+	for _, point := range hooks.Points {
+		print := func(h hooks.Hook, status string) {
+			path := h.Path
+			if err := hooks.Executable(h.Path); err != nil {
+				path += " (warning: " + err.Error() + ")"
+			}
+			fmt.Fprintf(tw, "%s/%s\t%s\t%s\n", h.Point, h.Name, status, path)
+		}
+		for _, h := range available {
+			if h.Point != point {
+				continue
+			}
+			status := "available"
+			if isEnabled[h.Point+"/"+h.Name] {
+				status = "enabled"
+			}
+			print(h, status)
+		}
+		for _, h := range enabled {
+			if h.Point != point || isAvailable[h.Point+"/"+h.Name] {
+				continue
+			}
+			print(h, "enabled") // not from a hooks-available directory
+		}
+	}
+	return tw.Flush()
+}
+
+// hooksCommand implements -hooks: args are list, enable <name> or
+// disable <name>.
+func (i *invocation) hooksCommand(w io.Writer, args []string) error {
+	const syntax = "syntax: pk4 -hooks list|enable <name>|disable <name>"
+	if len(args) == 0 {
+		return fmt.Errorf(syntax)
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return fmt.Errorf(syntax)
+		}
+		return i.listHooks(w)
+
+	case "enable":
+		if len(args) != 2 {
+			return fmt.Errorf(syntax)
+		}
+		available, err := i.availableHooks()
+		if err != nil {
+			return err
+		}
+		h, err := hooks.Find(available, args[1])
+		if err != nil {
+			return err
+		}
+		if err := i.hooksRunner().Enable(h); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "enabled %s/%s (%s)\n", h.Point, h.Name, h.Path)
+		return nil
+
+	case "disable":
+		if len(args) != 2 {
+			return fmt.Errorf(syntax)
+		}
+		r := i.hooksRunner()
+		enabled, err := r.Enabled()
+		if err != nil {
+			return err
+		}
+		h, err := hooks.Find(enabled, args[1])
+		if err != nil {
+			return err
+		}
+		if err := r.Disable(h); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "disabled %s/%s\n", h.Point, h.Name)
+		return nil
+	}
+	return fmt.Errorf(syntax)
+}
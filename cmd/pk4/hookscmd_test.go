@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHooksCommand(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	system := filepath.Join(tmp, "system")
+	writeTree(t, system, map[string]string{
+		"after-download/git-init": "#!/bin/sh\n",
+		"unpack/broken":           "#!/bin/sh\n",
+	})
+	if err := os.Chmod(filepath.Join(system, "after-download", "git-init"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	i := invocation{
+		configDir:      filepath.Join(tmp, "config"),
+		systemHooksDir: system,
+	}
+	var buf bytes.Buffer
+	if err := i.hooksCommand(&buf, []string{"enable", "git-init"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.hooksCommand(&buf, []string{"enable", "broken"}); err == nil {
+		t.Fatalf("enabling a non-executable hook unexpectedly succeeded")
+	}
+
+	buf.Reset()
+	if err := i.hooksCommand(&buf, []string{"list"}); err != nil {
+		t.Fatal(err)
+	}
+	want := `HOOK                     STATUS     PATH
+unpack/broken            available  ` + filepath.Join(system, "unpack", "broken") + ` (warning: ` + filepath.Join(system, "unpack", "broken") + ` is not executable (chmod +x?))
+after-download/git-init  enabled    ` + filepath.Join(system, "after-download", "git-init") + `
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected -hooks list output:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := i.hooksCommand(&buf, []string{"disable", "git-init"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(i.configDir, "hooks-enabled", "after-download", "git-init")); !os.IsNotExist(err) {
+		t.Fatalf("hook still enabled after disable: %v", err)
+	}
+}
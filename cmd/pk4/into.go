@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fileSha256 returns the hex-encoded SHA256 checksum of the file at path.
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// commitInto commits the source tree outputDir of srcpkg in srcversion onto
+// branch in the git repository repo, with the previous tip of branch (if any)
+// as parent, so that importing newer versions results in a linear history. The
+// checked out files of repo are only touched if branch is checked out, in which
+// case it is fast-forwarded. commitInto returns the resulting commit.
+func (i *invocation) commitInto(repo, branch, srcpkg, srcversion, outputDir string) (string, error) {
+	name, err := i.lookPath("git")
+	if err != nil {
+		return "", err
+	}
+
+	// A temporary index keeps the index of repo untouched.
+	tmp, err := ioutil.TempDir("", "pk4-into")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	env := append(os.Environ(), "GIT_INDEX_FILE="+filepath.Join(tmp, "index"))
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command(name, append([]string{"-C", repo}, args...)...)
+		cmd.Env = env
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	ref := "refs/heads/" + branch
+	if _, err := git("check-ref-format", ref); err != nil {
+		return "", fmt.Errorf("invalid branch name %q", branch)
+	}
+
+	// --force adds files ignored by .gitignore files of the source package, so
+	// that the commit contains the source exactly.
+	if _, err := git("--work-tree", outputDir, "add", "--all", "--force", "--", ".", ":(exclude).pc"); err != nil {
+		return "", err
+	}
+	tree, err := git("write-tree")
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := git("for-each-ref", "--format=%(objectname)", ref)
+	if err != nil {
+		return "", err
+	}
+	if parent != "" {
+		parentTree, err := git("rev-parse", parent+"^{tree}")
+		if err != nil {
+			return "", err
+		}
+		if parentTree == tree {
+			i.V().Printf("branch %s already contains %s %s", branch, srcpkg, srcversion)
+			return parent, nil
+		}
+	}
+
+	msg := fmt.Sprintf("Import %s %s\n\nPk4-Source: %s\nPk4-Version: %s\n", srcpkg, srcversion, srcpkg, srcversion)
+	if dsc, err := dscName(srcpkg, srcversion); err == nil {
+		if sum, err := fileSha256(filepath.Join(i.dest, dsc)); err == nil {
+			msg += "Pk4-Dsc-Sha256: " + sum + "\n"
+		} else if !os.IsNotExist(err) {
+			return "", err
+		} // e.g. the dgit backend does not download the .dsc file
+	}
+	args := []string{"commit-tree", tree, "-m", msg}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit, err := git(args...)
+	if err != nil {
+		return "", err
+	}
+
+	head, _ := git("symbolic-ref", "--quiet", "HEAD")
+	bare, err := git("rev-parse", "--is-bare-repository")
+	if err != nil {
+		return "", err
+	}
+	if head == ref && bare != "true" {
+		// Also update the working tree and index of repo.
+		env = os.Environ()
+		if _, err := git("merge", "--quiet", "--ff-only", commit); err != nil {
+			return "", err
+		}
+		return commit, nil
+	}
+	// Passing the old value guards against concurrent updates; an empty old
+	// value ensures a new branch does not overwrite an existing one.
+	if _, err := git("update-ref", "-m", "pk4: import "+srcpkg+" "+srcversion, ref, commit, parent); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
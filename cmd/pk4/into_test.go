@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommitInto(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	defer setGitIdentity()()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	repo := filepath.Join(dest, "repo")
+	if err := os.Mkdir(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(repo, "init", "--quiet")
+	git(repo, "commit", "--quiet", "--allow-empty", "-m", "Initial commit")
+
+	writeTree(t, dest, map[string]string{
+		"hello_1.0-1.dsc":                 "fake dsc\n",
+		"hello-1.0-1/hello.c":             "hello\n",
+		"hello-1.0-1/.gitignore":          "*.c\n",
+		"hello-1.0-1/.pc/applied-patches": "greet.patch\n",
+		"hello-1.0-2/hello.c":             "hello world\n",
+	})
+
+	i := invocation{
+		verbose:  *verbose,
+		dest:     dest,
+		lookPath: exec.LookPath,
+	}
+	first, err := i.commitInto(repo, "hello", "hello", "1.0-1", filepath.Join(dest, "hello-1.0-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := git(repo, "ls-tree", "-r", "--name-only", first), ".gitignore\nhello.c"; got != want {
+		t.Fatalf("unexpected files in commit: got %q, want %q", got, want)
+	}
+	msg := git(repo, "log", "-1", "--format=%B", first)
+	for _, trailer := range []string{
+		"Pk4-Source: hello",
+		"Pk4-Version: 1.0-1",
+		// sha256 of "fake dsc\n"
+		"Pk4-Dsc-Sha256: b6372df546d930cc3d31fcecf818e2a75fb75f5d5c0d1a8ddda658f128dfdfc6",
+	} {
+		if !strings.Contains(msg, trailer) {
+			t.Errorf("commit message %q does not contain %q", msg, trailer)
+		}
+	}
+
+	// Importing the same version again is a no-op.
+	again, err := i.commitInto(repo, "hello", "hello", "1.0-1", filepath.Join(dest, "hello-1.0-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Fatalf("re-import created commit %s, want %s", again, first)
+	}
+
+	// The branch is checked out: the working tree is fast-forwarded.
+	git(repo, "checkout", "--quiet", "hello")
+	second, err := i.commitInto(repo, "hello", "hello", "1.0-2", filepath.Join(dest, "hello-1.0-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := git(repo, "rev-parse", second+"^"), first; got != want {
+		t.Fatalf("unexpected parent: got %s, want %s", got, want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(repo, "hello.c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "hello world\n"; got != want {
+		t.Fatalf("working tree not updated: got %q, want %q", got, want)
+	}
+	if got := git(repo, "status", "--porcelain"); got != "" {
+		t.Fatalf("git status not clean after import:\n%s", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// errLocked is returned by tryLock when another process (or another download
+// within this process) holds a conflicting lock.
+var errLocked = errors.New("locked")
+
+// cacheLock is the name of the lock which serializes evictions (see
+// capDiskUsage) across pk4 processes.
+const cacheLock = "cache"
+
+// lockName returns the name of the lock which protects the source tree (and
+// .dsc file) of srcpkg in srcversion. Package names and versions cannot
+// contain underscores, so the name can be split unambiguously.
+//
+// Locking per version (instead of per source package) suffices for files which
+// are shared between versions, e.g. .orig.tar.gz files: concurrent downloads
+// of different versions write identical contents (verified by dpkg-source
+// against the .dsc checksums) using write.Atomically, and evict requires the
+// locks of all versions to delete such files (see locksFor).
+func lockName(srcpkg, srcversion string) string {
+	return srcpkg + "_" + srcversion
+}
+
+func (i *invocation) lockPath(name string) string {
+	return filepath.Join(i.dest, ".locks", name+".lock")
+}
+
+func (i *invocation) flock(name string, how int) (*os.File, error) {
+	path := i.lockPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// Lock files are never deleted: deleting a lock file races with other
+	// processes which opened (but did not yet lock) it.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// lock acquires an exclusive lock, waiting for other holders. Closing the
+// returned file releases the lock.
+func (i *invocation) lock(name string) (*os.File, error) {
+	f, err := i.flock(name, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != errLocked {
+		return f, err
+	}
+	log.Printf("waiting for another pk4 process to finish with %s", name)
+	return i.flock(name, syscall.LOCK_EX)
+}
+
+// lockShared acquires a shared lock, which prevents eviction while e.g. a
+// shell is open in the source tree. Closing the returned file releases the
+// lock.
+func (i *invocation) lockShared(name string) (*os.File, error) {
+	return i.flock(name, syscall.LOCK_SH)
+}
+
+// downgrade converts the exclusive lock l into a shared lock. flock(2) does not
+// convert locks atomically, so cacheLock is held meanwhile: source trees are
+// only evicted while holding cacheLock (see evict).
+func (i *invocation) downgrade(l *os.File) error {
+	c, err := i.lock(cacheLock)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for {
+		err = syscall.Flock(int(l.Fd()), syscall.LOCK_SH)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// tryLock acquires an exclusive lock without waiting. It returns errLocked if
+// the lock is held.
+func (i *invocation) tryLock(name string) (*os.File, error) {
+	return i.flock(name, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// locksFor returns the names of all locks which protect the entry name of
+// -dest: a source tree (<srcpkg>-<version>) is protected by the lock of its
+// version, a file (<srcpkg>_…) by the locks of all versions of its source
+// package, as e.g. .orig.tar.gz files are shared between versions.
+func (i *invocation) locksFor(name string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(i.dest, ".locks"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var locks []string
+	for _, fi := range fis {
+		lock := strings.TrimSuffix(fi.Name(), ".lock")
+		idx := strings.IndexByte(lock, '_')
+		if idx == -1 {
+			continue // e.g. cacheLock
+		}
+		srcpkg, srcversion := lock[:idx], lock[idx+1:]
+		tree := srcpkg + "-" + srcversion
+		if name == tree ||
+			name == filepath.Base(stampPath(tree)) ||
+			strings.HasPrefix(name, srcpkg+"_") {
+			locks = append(locks, lock)
+		}
+	}
+	return locks, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvictSkipsLocked(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeTree(t, dest, map[string]string{
+		"hello-2.10-1/debian/changelog": "open in a shell",
+		"hello-2.10-1.pk4.json":         "{}",
+		"hello_2.10.orig.tar.gz":        "shared between versions",
+		"hello-2.10-2/debian/changelog": "unused",
+	})
+	// Without a time of unpacking, the source tree would be kept as possibly
+	// modified.
+	if err := writeStamp(filepath.Join(dest, "hello-2.10-2"), &stamp{
+		Source:   "hello",
+		Version:  "2.10-2",
+		Unpacked: time.Now().UTC(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	i := invocation{
+		verbose:        *verbose,
+		dest:           dest,
+		diskUsageLimit: 0,
+	}
+	for _, lock := range []string{lockName("hello", "2.10-1"), lockName("hello", "2.10-2")} {
+		f, err := i.lock(lock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	locks, err := i.locksFor("hello_2.10.orig.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := locks, []string{"hello_2.10-1", "hello_2.10-2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("locksFor(orig.tar.gz) = %v, want %v", got, want)
+	}
+
+	l, err := i.lockShared(lockName("hello", "2.10-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := i.tryLock(lockName("hello", "2.10-1")); err != errLocked {
+		t.Fatalf("tryLock on a shared-locked lock: got err %v, want %v", err, errLocked)
+	}
+
+	if err := i.capDiskUsage("unrelated", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hello-2.10-1", "hello-2.10-1.pk4.json", "hello_2.10.orig.tar.gz"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("locked entry %s unexpectedly evicted: %v", name, err)
+		}
+	}
+	for _, name := range []string{"hello-2.10-2", "hello-2.10-2.pk4.json"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("unlocked entry %s not evicted: %v", name, err)
+		}
+	}
+}
+
+func TestDownloadShared(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	writeTree(t, dest, map[string]string{
+		"hello-2.10-1/debian/changelog": "open in a shell",
+		"hello-2.10-1.pk4.json":         "{}",
+	})
+
+	i := invocation{
+		verbose:        *verbose,
+		dest:           dest,
+		diskUsageLimit: 0,
+	}
+	_, l, err := i.downloadShared("hello", "2.10-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := i.tryLock(lockName("hello", "2.10-1")); err != errLocked {
+		t.Fatalf("tryLock after downloadShared: got err %v, want %v", err, errLocked)
+	}
+
+	// Another pk4 process must not wait for the shell to exit:
+	done := make(chan error)
+	go func() {
+		_, l, err := i.downloadShared("hello", "2.10-1")
+		if err == nil {
+			l.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("downloadShared of a source tree in use did not return")
+	}
+
+	if err := i.capDiskUsage("unrelated", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "hello-2.10-1")); err != nil {
+		t.Errorf("source tree in use unexpectedly evicted: %v", err)
+	}
+}
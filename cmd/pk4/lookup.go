@@ -73,6 +73,9 @@ func lookup(path, key string) (string, error) {
 
 	var blockIndex index.BlockLocation
 	if err := binary.Read(f, binary.LittleEndian, &blockIndex); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", notFound // key is longer than all keys in the index
+		}
 		return "", err
 	}
 
@@ -109,6 +112,8 @@ func lookup(path, key string) (string, error) {
 	}
 
 	scanner := bufio.NewScanner(f)
+	// Values of debs.index list all binary packages of a source package.
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
 	if !scanner.Scan() {
 		return "", scanner.Err()
 	}
@@ -123,9 +128,11 @@ func (inv *invocation) lookupDSC(srcpkg, srcversion string) (index.DSC, error) {
 		return index.DSC{}, err
 	}
 
-	parts := strings.Split(strings.TrimSpace(val), "\t")
-	if got, want := len(parts), 2; got != want {
-		return index.DSC{}, fmt.Errorf(`corrupt index: len(Split(%q, "\t")) = %d, want %d`, val, got, want)
+	// Index files generated by older versions of pk4-generate-index do not
+	// contain the Origin and Label columns.
+	parts := strings.Split(strings.TrimRight(val, "\r\n"), "\t")
+	if got := len(parts); got != 2 && got != 4 {
+		return index.DSC{}, fmt.Errorf(`corrupt index: len(Split(%q, "\t")) = %d, want 2 or 4`, val, got)
 	}
 
 	size, err := strconv.ParseInt(parts[1], 0, 64)
@@ -133,7 +140,44 @@ func (inv *invocation) lookupDSC(srcpkg, srcversion string) (index.DSC, error) {
 		return index.DSC{}, err
 	}
 
-	return index.DSC{URL: parts[0], Size: size}, nil
+	dsc := index.DSC{URL: parts[0], Size: size}
+	if len(parts) == 4 {
+		dsc.Origin = parts[2]
+		dsc.Label = parts[3]
+	}
+	return dsc, nil
+}
+
+// lookupDebs returns the binary packages built from srcpkg in srcversion, as
+// per the index file indexName (debs.index or dbgsym.index).
+func (inv *invocation) lookupDebs(indexName, srcpkg, srcversion string) ([]index.Deb, error) {
+	key := fmt.Sprintf("%s\t%s", srcpkg, srcversion)
+	val, err := lookup(filepath.Join(inv.indexDir, indexName), key)
+	if err != nil {
+		return nil, err
+	}
+
+	const columns = 6 // see index.Debs.Encode
+	parts := strings.Split(strings.TrimRight(val, "\r\n"), "\t")
+	if got := len(parts); got%columns != 0 {
+		return nil, fmt.Errorf(`corrupt index: len(Split(%q, "\t")) = %d, want a multiple of %d`, val, got, columns)
+	}
+	debs := make([]index.Deb, 0, len(parts)/columns)
+	for ; len(parts) > 0; parts = parts[columns:] {
+		size, err := strconv.ParseInt(parts[5], 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		debs = append(debs, index.Deb{
+			Package:      parts[0],
+			Version:      parts[1],
+			Architecture: parts[2],
+			URL:          parts[3],
+			SHA256:       parts[4],
+			Size:         size,
+		})
+	}
+	return debs, nil
 }
 
 func (inv *invocation) lookup(key string) (srcpkg string, srcversion string, _ error) {
@@ -10,7 +10,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Debian/pk4/internal/hooks"
 	"github.com/Debian/pk4/internal/humanbytes"
 
 	"pault.ag/go/debian/control"
@@ -30,12 +33,26 @@ type invocation struct {
 	bin            bool
 	src            bool
 	version        string
+	at             string
+	suite          string
 	file           bool
 	arg            string
 	indexDir       string
 	configDir      string
 	verbose        bool
+	offline        bool
+	aptMethods     bool
+	backend        string
+	gitImport      bool
 	diskUsageLimit int64
+	force          bool
+	hookTimeout    time.Duration
+	origins        []origin
+
+	// snapshotArchives are the snapshot.debian.org archives in which pk4
+	// looks for source packages which are not in the index, in order of
+	// preference.
+	snapshotArchives []snapshotArchive
 
 	// TODO(security): ideally, allowUnauthenticated would not be implemented at
 	// all. However, snapshot.debian.org does not currently provide an
@@ -46,9 +63,21 @@ type invocation struct {
 	// revoking his key, rendering the fluxbox signatures unverifiable.
 	allowUnauthenticated bool
 
-	snapshotBase string                            // for testing
-	mirrorUrl    string                            // for testing
-	lookPath     func(file string) (string, error) // for testing
+	snapshotBase   string                            // for testing
+	mirrorUrl      string                            // for testing
+	launchpadBase  string                            // for testing
+	metadataBase   string                            // for testing
+	aptMethodsDir  string                            // for testing
+	systemHooksDir string                            // for testing
+	lookPath       func(file string) (string, error) // for testing
+
+	// methodsMu guards the apt acquire methods, which are started once per
+	// URI scheme, and the apt configuration sent to them (see
+	// fetchViaMethod).
+	methodsMu     sync.Mutex
+	methods       map[string]*aptMethod // by path
+	aptConfig     []string
+	aptConfigRead bool
 }
 
 func (i *invocation) V() verboseLogger {
@@ -64,7 +93,11 @@ func (i *invocation) readConfig(configPath string) error {
 		return err
 	}
 	var config struct {
-		DiskUsageLimit string `control:"Disk-Usage-Limit"`
+		DiskUsageLimit   string   `control:"Disk-Usage-Limit"`
+		SnapshotArchives []string `control:"Snapshot-Archives" delim:"\n" strip:"\n\r\t "`
+		Backend          string
+		GitImport        string `control:"Git-Import"`
+		HookTimeout      string `control:"Hook-Timeout"`
 	}
 	if err := control.Unmarshal(&config, bytes.NewReader(b)); err != nil {
 		return err
@@ -77,6 +110,32 @@ func (i *invocation) readConfig(configPath string) error {
 			i.diskUsageLimit = v
 		}
 	}
+	if config.Backend != "" {
+		i.backend = config.Backend
+	}
+	if config.HookTimeout != "" {
+		if v, err := time.ParseDuration(config.HookTimeout); err != nil {
+			log.Printf("invalid Hook-Timeout value %q in config file %s: %v", config.HookTimeout, configPath, err)
+		} else {
+			i.hookTimeout = v
+		}
+	}
+	switch config.GitImport {
+	case "":
+	case "yes":
+		i.gitImport = true
+	case "no":
+		i.gitImport = false
+	default:
+		log.Printf("invalid Git-Import value %q in config file %s: expected yes or no", config.GitImport, configPath)
+	}
+	if len(config.SnapshotArchives) > 0 {
+		if v, err := parseSnapshotArchives(config.SnapshotArchives); err != nil {
+			log.Printf("invalid Snapshot-Archives value in config file %s: %v", configPath, err)
+		} else {
+			i.snapshotArchives = v
+		}
+	}
 	return nil
 }
 
@@ -95,12 +154,18 @@ func resolveTilde(s string) string {
 
 func main() {
 	i := invocation{
-		lookPath:       exec.LookPath,
-		indexDir:       "/var/cache/pk4",
-		diskUsageLimit: 1 * 1024 * 1024 * 1024, // 1 GB
+		lookPath:         exec.LookPath,
+		indexDir:         "/var/cache/pk4",
+		diskUsageLimit:   1 * 1024 * 1024 * 1024, // 1 GB
+		hookTimeout:      hooks.DefaultTimeout,
+		snapshotArchives: defaultSnapshotArchives,
 		// TODO(https://bugs.debian.org/740096): switch to https once available
-		snapshotBase: "http://snapshot.debian.org/",
-		mirrorUrl:    "https://deb.debian.org/debian",
+		snapshotBase:   "http://snapshot.debian.org/",
+		mirrorUrl:      "https://deb.debian.org/debian",
+		launchpadBase:  "https://launchpad.net/",
+		metadataBase:   "https://metadata.ftp-master.debian.org/",
+		aptMethodsDir:  "/usr/lib/apt/methods",
+		systemHooksDir: "/usr/share/pk4/hooks-available",
 	}
 
 	flag.StringVar(&i.dest, "dest",
@@ -119,6 +184,14 @@ func main() {
 		"",
 		"Use the specified source package version (default: installed package version, or latest known if not installed)")
 
+	flag.StringVar(&i.at, "at",
+		"",
+		"Use the source package version which was current in -suite at the specified date (e.g. 2024-03-01 or 2024-03-01T12:00:00Z), as recorded by snapshot.debian.org")
+
+	flag.StringVar(&i.suite, "suite",
+		"unstable",
+		"Suite (e.g. testing) in which to look up the source package version when -at is specified, and from which -backend=dgit clones")
+
 	flag.BoolVar(&i.file, "file",
 		false,
 		"Interpret the argument as a file name and operate on the package providing the file")
@@ -127,6 +200,66 @@ func main() {
 		false,
 		"Whether to allow unauthenticated source packages, i.e. disable signature checking")
 
+	flag.BoolVar(&i.offline, "offline",
+		false,
+		"Forbid network access: only download source packages from file:// or copy:// mirrors")
+
+	flag.BoolVar(&i.aptMethods, "apt_methods",
+		false,
+		"Download files using apt’s acquire methods (/usr/lib/apt/methods), which provides the same transports, credentials and proxy configuration as apt. URI schemes which pk4 does not support natively always use apt’s acquire methods.")
+
+	flag.StringVar(&i.backend, "backend",
+		"",
+		"How to make available source packages: dsc (download the .dsc file and unpack it) or dgit (clone the git history using dgit, falling back to dsc). Defaults to the Backend config option, or dsc.")
+
+	debs := flag.Bool("debs",
+		false,
+		"Download the binary packages (.deb files) built from the resolved source package version for the host architecture into -dest, then print their paths to stdout and exit")
+
+	dbgsym := flag.Bool("dbgsym",
+		false,
+		"Download the debug symbol packages (-dbgsym) matching the installed binary packages built from the resolved source package version into -dest, then print their paths to stdout and exit (see also -install)")
+
+	install := flag.Bool("install",
+		false,
+		"With -dbgsym, install the downloaded debug symbol packages using sudo dpkg -i")
+
+	gitImport := flag.Bool("git_import",
+		false,
+		"Import the source into a git repository with branches upstream, debian and patches-applied (one commit per quilt patch)")
+
+	exportPatches := flag.Bool("export_patches",
+		false,
+		"Regenerate debian/patches from the commits on top of the debian branch in the git repository in the current directory (see -git_import)")
+
+	into := flag.String("into",
+		"",
+		"Path to a git repository into which to commit the source (see -branch), instead of starting a shell")
+
+	branch := flag.String("branch",
+		"",
+		"Branch of the -into repository onto which to commit the source. Each import is committed on top of the previous one")
+
+	manageHooks := flag.Bool("hooks",
+		false,
+		"Manage hooks: list shows available and enabled hooks, enable <name> and disable <name> (un)link hooks from hooks-available into hooks-enabled")
+
+	manageCache := flag.Bool("cache",
+		false,
+		"Manage -dest: list shows source trees with their size and state, du prints the total size, gc [-limit <bytes>] evicts least recently used source trees, rm <pkg>[=<version>] removes a source package")
+
+	flag.BoolVar(&i.force, "force",
+		false,
+		"Evict locally modified source trees (uncommitted git changes, files modified after unpacking, dpkg-source --commit patches) to stay within Disk-Usage-Limit (see the configuration file), allow -cache rm to remove them, and replace source trees which were unpacked without stamp file and cannot be adopted")
+
+	pin := flag.Bool("pin",
+		false,
+		"Pin the specified source trees (paths, or names within -dest), so that they are never evicted to stay within Disk-Usage-Limit (see the configuration file)")
+
+	unpin := flag.Bool("unpin",
+		false,
+		"Unpin the specified source trees (see -pin)")
+
 	flag.BoolVar(&i.verbose, "verbose",
 		false,
 		"Whether to print messages to stderr")
@@ -139,6 +272,22 @@ func main() {
 		false,
 		`Resolve the provided arguments to source package and source package version, then print them to stdout in %s\t%s\n format and exit`)
 
+	versions := flag.String("versions",
+		"",
+		`Download all known source package versions within the specified range (e.g. ">=1.2-1,<=1.4-2"), then print their output directories to stdout in ascending version order and exit`)
+
+	showChangelog := flag.Bool("changelog",
+		false,
+		"Print the changelog entries between the installed and the candidate version of the package(s), then exit")
+
+	diff := flag.Bool("diff",
+		false,
+		"Print a summary and a unified diff between two versions of the source package: pk4 -diff <package> [<old version> <new version>] (default: installed version against candidate version)")
+
+	diffMode := flag.String("diff_mode",
+		"tree",
+		"How -diff compares versions: tree (summary of debian/ changes, patches and changelog entries, then diff -Nru of the unpacked trees) or debdiff (debdiff(1) on the .dsc files)")
+
 	shell := flag.String("shell",
 		os.Getenv("SHELL"),
 		"Which shell to start in the output directory after downloading the source")
@@ -149,16 +298,103 @@ func main() {
 		log.Fatalf("At most one of -bin or -src must be specified, not both")
 	}
 
+	if *versions != "" && (i.version != "" || i.at != "") {
+		log.Fatalf("-versions cannot be combined with -version or -at")
+	}
+
+	if (*debs || *dbgsym) && *versions != "" {
+		log.Fatalf("-debs and -dbgsym cannot be combined with -versions")
+	}
+
+	if *install && !*dbgsym {
+		log.Fatalf("-install requires -dbgsym")
+	}
+
+	if (*into == "") != (*branch == "") {
+		log.Fatalf("-into and -branch must be specified together")
+	}
+	*into = resolveTilde(*into)
+
 	i.dest = resolveTilde(i.dest)
 	i.configDir = resolveTilde("~/.config/pk4")
 	configPath := filepath.Join(i.configDir, "pk4.deb822")
+	backendFlag := i.backend
 	if err := i.readConfig(configPath); err != nil {
 		log.Fatal(err)
 	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "git_import" {
+			i.gitImport = *gitImport // flag overrides config
+		}
+	})
+	if backendFlag != "" {
+		i.backend = backendFlag // flag overrides config
+	}
+	if i.backend == "" {
+		i.backend = "dsc"
+	}
+	if i.backend != "dsc" && i.backend != "dgit" {
+		log.Fatalf("invalid backend %q: expected dsc or dgit", i.backend)
+	}
+	if err := i.readOrigins(filepath.Join(i.configDir, "origins.deb822")); err != nil {
+		log.Fatal(err)
+	}
 
 	if err := os.MkdirAll(i.dest, 0755); err != nil {
 		log.Fatal(err)
 	}
+	defer i.closeMethods()
+
+	if *manageHooks {
+		if err := i.hooksCommand(os.Stdout, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *manageCache {
+		if err := i.cacheCommand(os.Stdout, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *pin || *unpin {
+		if *pin && *unpin {
+			log.Fatalf("At most one of -pin or -unpin must be specified, not both")
+		}
+		if err := i.pin(flag.Args(), *pin); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *exportPatches {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := i.exportPatches(os.Stdout, wd); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *showChangelog {
+		for _, arg := range flag.Args() {
+			if err := i.changelog(os.Stdout, arg); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+
+	if *diff {
+		if err := i.diff(os.Stdout, flag.Args(), *diffMode); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	for n := 0; n < flag.NArg(); n++ {
 		i.arg = flag.Arg(n)
@@ -184,11 +420,78 @@ func main() {
 			return
 		}
 
-		outputDir, err := i.download(srcpkg, srcversion)
+		env := hooks.Env{Source: srcpkg, Version: srcversion}
+		if _, err := i.runHooks(hooks.AfterResolve, i.dest, env); err != nil {
+			log.Printf("hook failure: %v", err)
+			// hooks are best-effort, don’t fail
+		}
+
+		if *debs {
+			paths, err := i.downloadDebs(srcpkg, srcversion)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, path := range paths {
+				fmt.Println(path)
+			}
+			continue
+		}
+
+		if *dbgsym {
+			paths, err := i.downloadDbgsym(srcpkg, srcversion)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, path := range paths {
+				fmt.Println(path)
+			}
+			if *install {
+				if err := installDebs(paths); err != nil {
+					log.Fatal(err)
+				}
+			}
+			continue
+		}
+
+		if *versions != "" {
+			outputDirs, err := i.downloadVersions(srcpkg, *versions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, outputDir := range outputDirs {
+				if *into != "" {
+					// outputDirs are ordered by version, resulting in one
+					// commit per version.
+					v := strings.TrimPrefix(filepath.Base(outputDir), srcpkg+"-")
+					commit, err := i.commitInto(*into, *branch, srcpkg, v, outputDir)
+					if err != nil {
+						log.Fatal(err)
+					}
+					fmt.Println(commit)
+					continue
+				}
+				fmt.Println(outputDir)
+			}
+			continue
+		}
+
+		// Prevent eviction of the source tree by other pk4 processes while
+		// the shell is open. The lock is released when pk4 exits.
+		outputDir, l, err := i.downloadShared(srcpkg, srcversion)
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer l.Close()
+		if *into != "" {
+			commit, err := i.commitInto(*into, *branch, srcpkg, srcversion, outputDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(commit)
+			continue
+		}
 		if flag.NArg() == 1 {
+			i.closeMethods() // not needed while the shell is open
 			subshell := exec.Command(*shell)
 			subshell.Dir = outputDir
 			subshell.Stdout = os.Stdout
@@ -201,6 +504,10 @@ func main() {
 	if flag.NArg() == 1 {
 		return // already started a shell in the for loop, done
 	}
+	if *versions != "" || *into != "" || *debs || *dbgsym {
+		return // output is meant for scripts, not for a shell
+	}
+	i.closeMethods() // not needed while the shell is open
 	subshell := exec.Command(*shell)
 	subshell.Dir = i.dest
 	subshell.Stdout = os.Stdout
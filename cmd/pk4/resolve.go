@@ -68,7 +68,14 @@ func (i *invocation) resolveFile(path string) (string, error) {
 	return packages[0], nil
 }
 
-func (i *invocation) binaryPkgsOf(srcpkg string) ([]string, error) {
+// showsrcEntry is one paragraph of apt-cache showsrc output.
+type showsrcEntry struct {
+	Package string
+	Version version.Version
+	Binary  []string `control:"Binary" delim:"," strip:" "`
+}
+
+func (i *invocation) showsrc(srcpkg string) ([]showsrcEntry, error) {
 	name, err := i.lookPath("apt-cache")
 	if err != nil {
 		return nil, err
@@ -80,12 +87,128 @@ func (i *invocation) binaryPkgsOf(srcpkg string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	var pkgs []showsrcEntry
+	if err := control.Unmarshal(&pkgs, bytes.NewReader(out)); err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
+// policyCandidates returns the candidate versions (i.e. the versions apt would
+// install, taking pinning into account) of binaries by package name, as
+// printed by apt-cache policy. Packages without candidate are omitted.
+func (i *invocation) policyCandidates(binaries []string) (map[string]version.Version, error) {
+	name, err := i.lookPath("apt-cache")
+	if err != nil {
+		return nil, err
+	}
+	policy := exec.Command(name, append([]string{"policy"}, binaries...)...)
+	policy.Stderr = os.Stderr
+	out, err := policy.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", policy.Args, err)
+	}
+	candidates := make(map[string]version.Version)
+	var pkg string
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, " ") && strings.HasSuffix(line, ":") {
+			pkg = strings.TrimSuffix(line, ":")
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "Candidate:") || pkg == "" {
+			continue
+		}
+		candidate := strings.TrimSpace(strings.TrimPrefix(line, "Candidate:"))
+		if candidate == "(none)" {
+			continue
+		}
+		v, err := version.Parse(candidate)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %s: %v", policy.Args, pkg, err)
+		}
+		candidates[pkg] = v
+	}
+	return candidates, nil
+}
+
+// sourceVersionOf returns the version of the source package from which version
+// binversion of binary package binpkg was built, which differs from binversion
+// for binary-only uploads (binNMUs).
+func (i *invocation) sourceVersionOf(binpkg string, binversion version.Version) (string, error) {
+	name, err := i.lookPath("apt-cache")
+	if err != nil {
+		return "", err
+	}
+	show := exec.Command(name, "show", binpkg+"="+binversion.String())
+	show.Stderr = os.Stderr
+	out, err := show.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", show.Args, err)
+	}
 	var pkgs []struct {
 		Package string
 		Version version.Version
-		Binary  []string `control:"Binary" delim:"," strip:" "`
+		Source  string
 	}
 	if err := control.Unmarshal(&pkgs, bytes.NewReader(out)); err != nil {
+		return "", err
+	}
+	if len(pkgs) == 0 {
+		return "", fmt.Errorf("%v: no package found", show.Args)
+	}
+	// Source is either absent, e.g. "xorg-server", or, if the versions
+	// differ, e.g. "xorg-server (2:1.19.3-2)".
+	source := pkgs[0].Source
+	if idx := strings.Index(source, "("); idx > -1 {
+		return strings.TrimSpace(strings.Trim(source[idx:], "()")), nil
+	}
+	return pkgs[0].Version.String(), nil
+}
+
+// candidateVersion returns the source version of apt's candidate for the binary
+// packages of srcpkg, i.e. the version which apt would install, taking pinning
+// into account (see apt_preferences(5)).
+func (i *invocation) candidateVersion(srcpkg string) (string, error) {
+	binaries, err := i.binaryPkgsOf(srcpkg)
+	if err != nil {
+		return "", err
+	}
+	if len(binaries) == 0 {
+		return "", fmt.Errorf("source package %q not found", srcpkg)
+	}
+	sort.Strings(binaries)
+	candidates, err := i.policyCandidates(binaries)
+	if err != nil {
+		return "", err
+	}
+	var (
+		binpkg     string
+		binversion version.Version
+	)
+	for _, pkg := range binaries {
+		v, ok := candidates[pkg]
+		if !ok {
+			continue
+		}
+		if binpkg == "" || version.Compare(v, binversion) > 0 {
+			binpkg, binversion = pkg, v
+		}
+	}
+	if binpkg == "" {
+		return "", fmt.Errorf("none of the binary packages of source package %q has an installation candidate", srcpkg)
+	}
+	srcversion, err := i.sourceVersionOf(binpkg, binversion)
+	if err != nil {
+		return "", err
+	}
+	i.V().Printf("candidate %s %s was built from source package %s %s", binpkg, binversion, srcpkg, srcversion)
+	return srcversion, nil
+}
+
+func (i *invocation) binaryPkgsOf(srcpkg string) ([]string, error) {
+	pkgs, err := i.showsrc(srcpkg)
+	if err != nil {
 		return nil, err
 	}
 	present := make(map[string]bool)
@@ -127,6 +250,55 @@ func (i *invocation) firstInstalledOf(binaries []string) (string, error) {
 	return "", fmt.Errorf("none of these packages is installed: %v", binaries)
 }
 
+// installedVersion returns the source version of the installed binary packages
+// of srcpkg, as recorded by dpkg. If binary packages of different source
+// versions are installed, the lowest version is returned.
+func (i *invocation) installedVersion(srcpkg string) (string, error) {
+	binaries, err := i.binaryPkgsOf(srcpkg)
+	if err != nil {
+		return "", err
+	}
+	if len(binaries) == 0 {
+		return "", fmt.Errorf("source package %q not found", srcpkg)
+	}
+	sort.Strings(binaries)
+	name, err := i.lookPath("dpkg-query")
+	if err != nil {
+		return "", err
+	}
+	query := exec.Command(name, append([]string{
+		"--show",
+		"--showformat", "${Package}\t${db:Status-Status}\t${source:Version}\n",
+	}, binaries...)...)
+	// Intentionally discard stderr: dpkg-query will print one line to stderr
+	// for each package which is not installed.
+	out, err := query.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return "", err
+		}
+		// exec.ExitError is okay, dpkg-query still returns partial output.
+	}
+	var installed *version.Version
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Split(line, "\t")
+		if len(parts) != 3 || parts[1] != "installed" {
+			continue // e.g. removed, but not purged
+		}
+		v, err := version.Parse(parts[2])
+		if err != nil {
+			return "", fmt.Errorf("%v: %s: %v", query.Args, parts[0], err)
+		}
+		if installed == nil || version.Compare(v, *installed) < 0 {
+			installed = &v
+		}
+	}
+	if installed == nil {
+		return "", fmt.Errorf("no binary package of source package %q is installed", srcpkg)
+	}
+	return installed.String(), nil
+}
+
 func (i *invocation) resolveSource(arg0 string) (srcpkg string, srcversion string, _ error) {
 	srcpkg = arg0
 	if i.version != "" {
@@ -190,6 +362,9 @@ func (i *invocation) resolveBinary(binpkg string) (srcpkg string, srcversion str
 }
 
 func (i *invocation) resolve() (srcpkg string, srcversion string, _ error) {
+	if i.at != "" {
+		return i.resolveAt()
+	}
 	if i.src {
 		return i.resolveSource(i.arg)
 	}
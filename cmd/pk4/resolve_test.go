@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/Debian/pk4/internal/index"
@@ -27,7 +28,7 @@ func TestResolve(t *testing.T) {
 		wantSrcpkg     string
 		wantSrcversion string
 
-		invocation
+		*invocation
 	}{
 		{
 			name:           "BinaryPackageInstalled", // TODO: add a corresponding test for index creation
@@ -40,7 +41,7 @@ func TestResolve(t *testing.T) {
 				},
 			},
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				arg:     "xserver-xephyr",
 			},
@@ -57,7 +58,7 @@ func TestResolve(t *testing.T) {
 				},
 			},
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				arg:     "xserver-xephyr:amd64",
 			},
@@ -74,7 +75,7 @@ func TestResolve(t *testing.T) {
 				},
 			},
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				arg:     "xserver-xephyr",
 				version: "3:1.22",
@@ -92,7 +93,7 @@ func TestResolve(t *testing.T) {
 			wantSrcpkg:     "fluxbox",
 			wantSrcversion: "1.3.5-2",
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				arg:     "fluxbox",
 			},
@@ -109,7 +110,7 @@ func TestResolve(t *testing.T) {
 			wantSrcpkg:     "fluxbox",
 			wantSrcversion: "4:1.55",
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				arg:     "fluxbox",
 				version: "4:1.55",
@@ -127,7 +128,7 @@ func TestResolve(t *testing.T) {
 				},
 			},
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				src:     true,
 				arg:     "xorg-server",
@@ -145,7 +146,7 @@ func TestResolve(t *testing.T) {
 			wantSrcpkg:     "xorg-server",
 			wantSrcversion: "2:1.19.3-2",
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				src:     false,
 				arg:     "xorg-server",
@@ -163,7 +164,7 @@ func TestResolve(t *testing.T) {
 			wantSrcpkg:     "xorg-server",
 			wantSrcversion: "2:1.19.1-4",
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				src:     true,
 				arg:     "xorg-server",
@@ -175,7 +176,7 @@ func TestResolve(t *testing.T) {
 			wantSrcpkg:     "hello",
 			wantSrcversion: "2.10-1",
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				src:     true,
 				version: "2.10-1",
@@ -194,7 +195,7 @@ func TestResolve(t *testing.T) {
 				},
 			},
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				file:    true,
 				arg:     vimAbs,
@@ -212,7 +213,7 @@ func TestResolve(t *testing.T) {
 				},
 			},
 
-			invocation: invocation{
+			invocation: &invocation{
 				verbose: *verbose,
 				file:    false,
 				arg:     vimAbs,
@@ -230,6 +231,9 @@ func TestResolve(t *testing.T) {
 			defer os.RemoveAll(dest)
 
 			i := entry.invocation
+			if i == nil {
+				i = &invocation{}
+			}
 			i.dest = filepath.Join(dest, "dest")
 
 			if len(entry.idx) > 0 {
@@ -265,3 +269,46 @@ func TestResolve(t *testing.T) {
 		})
 	}
 }
+
+func TestCandidateVersion(t *testing.T) {
+	t.Parallel()
+
+	i := invocation{
+		verbose: *verbose,
+		lookPath: func(file string) (string, error) {
+			return filepath.Join("testdata", "CandidateVersion", file), nil
+		},
+	}
+	// The highest available version is 2:1.19.3-2, but the candidate is the
+	// pinned binNMU 2:1.19.1-4+b1.
+	got, err := i.candidateVersion("xorg-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2:1.19.1-4"; got != want {
+		t.Fatalf("unexpected candidate version: got %q, want %q", got, want)
+	}
+}
+
+func TestInstalledVersion(t *testing.T) {
+	t.Parallel()
+
+	i := invocation{
+		verbose: *verbose,
+		lookPath: func(file string) (string, error) {
+			return filepath.Join("testdata", "InstalledVersion", file), nil
+		},
+	}
+	got, err := i.installedVersion("xorg-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2:1.19.1-4"; got != want {
+		t.Fatalf("unexpected installed version: got %q, want %q", got, want)
+	}
+
+	// hello was removed, only its configuration files remain.
+	if _, err := i.installedVersion("hello"); err == nil || !strings.Contains(err.Error(), "is installed") {
+		t.Fatalf("installedVersion(hello): got err %v, want an error about hello not being installed", err)
+	}
+}
@@ -1,28 +1,18 @@
 package main
 
 import (
-	"io/ioutil"
-	"os"
-	"os/exec"
 	"path/filepath"
+
+	"github.com/Debian/pk4/internal/hooks"
 )
 
-func (i *invocation) runHooks(hookDir, wd string, args []string) (found bool, _ error) {
-	fis, err := ioutil.ReadDir(hookDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, err
-	}
-	for _, fi := range fis {
-		hook := exec.Command(filepath.Join(hookDir, fi.Name()), args...)
-		hook.Dir = wd
-		hook.Stderr = os.Stderr
-		hook.Stdout = os.Stderr
-		if err := hook.Run(); err != nil {
-			return true, err
-		}
+func (i *invocation) hooksRunner() *hooks.Runner {
+	return &hooks.Runner{
+		Dir:     filepath.Join(i.configDir, "hooks-enabled"),
+		Timeout: i.hookTimeout,
 	}
-	return len(fis) > 0, nil
+}
+
+func (i *invocation) runHooks(point, wd string, env hooks.Env, args ...string) (found bool, _ error) {
+	return i.hooksRunner().Run(point, wd, env, args...)
 }
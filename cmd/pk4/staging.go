@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// stagingPrefix is the name prefix of temporary directories underneath -dest,
+// in which source trees are assembled before being renamed into place. The
+// prefix is followed by the process id of the pk4 process which created the
+// directory, so that stale staging directories can be recognized.
+const stagingPrefix = ".pk4-staging-"
+
+// stagingDir creates a new staging directory underneath -dest. The caller is
+// responsible for removing it.
+func (i *invocation) stagingDir() (string, error) {
+	return ioutil.TempDir(i.dest, stagingPrefix+strconv.Itoa(os.Getpid())+"-")
+}
+
+// processAlive reports whether a process with the specified pid exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// cleanStaging removes staging directories which were left behind by pk4
+// processes which no longer run, e.g. because they were interrupted.
+func (i *invocation) cleanStaging() error {
+	fis, err := ioutil.ReadDir(i.dest)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), stagingPrefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(fi.Name(), stagingPrefix)
+		pid, err := strconv.Atoi(strings.SplitN(rest, "-", 2)[0])
+		if err != nil || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+		i.V().Printf("removing stale staging directory %s", fi.Name())
+		if err := os.RemoveAll(filepath.Join(i.dest, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCleanStaging(t *testing.T) {
+	t.Parallel()
+
+	dest, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	const deadPid = 2147483647 // larger than any Linux pid_max
+	stale := stagingPrefix + strconv.Itoa(deadPid) + "-123"
+	own := stagingPrefix + strconv.Itoa(os.Getpid()) + "-456"
+	writeTree(t, dest, map[string]string{
+		stale + "/hello-2.10-1/debian/changelog": "partial",
+		own + "/hello-2.10-2/debian/changelog":   "in progress",
+		"hello-2.10-1/debian/changelog":          "complete",
+	})
+
+	i := invocation{
+		verbose: *verbose,
+		dest:    dest,
+	}
+	if err := i.cleanStaging(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, stale)); !os.IsNotExist(err) {
+		t.Errorf("stale staging directory not removed: %v", err)
+	}
+	for _, name := range []string{own, "hello-2.10-1"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("%s unexpectedly removed: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/Debian/pk4/internal/write"
+	"pault.ag/go/debian/control"
+)
+
+// stamp records how pk4 produced a source tree. pk4 writes it next to the tree
+// once the tree is complete, so trees without a stamp (e.g. left behind by a
+// failed dpkg-source -x) can be recognized as incomplete.
+type stamp struct {
+	Arg     string `json:"arg"` // as specified on the command line
+	Source  string `json:"source"`
+	Version string `json:"version"`
+	Backend string `json:"backend"`
+	Origin  string `json:"origin"` // see sourceInfo.origin
+	DscURL  string `json:"dsc_url,omitempty"`
+
+	// Sha256 maps the file names of the .dsc file and all files referenced by
+	// it to their SHA256 checksum.
+	Sha256 map[string]string `json:"sha256,omitempty"`
+
+	// Signer is the key which signed the .dsc file according to dscverify(1),
+	// empty with -allow_unauthenticated.
+	Signer string `json:"signer,omitempty"`
+
+	Downloaded time.Time `json:"downloaded"` // start of the download
+	Unpacked   time.Time `json:"unpacked"`   // completion of the unpack
+	LastUsed   time.Time `json:"last_used"`  // see -dest eviction
+
+	// Pinned source trees are never evicted, see -pin.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Size is the disk usage of the source tree in bytes as of SizeAt, see
+	// treeSize. Hardlinks lists the hardlinked files included in Size with
+	// their disk usage, so that they can be counted once in the disk usage of
+	// -dest.
+	Size      int64            `json:"size,omitempty"`
+	Hardlinks map[fileID]int64 `json:"hardlinks,omitempty"`
+	SizeAt    time.Time        `json:"size_at"`
+
+	// DownloadSize is the size of the .dsc file and all files referenced by
+	// it in bytes, see unpackRatio.
+	DownloadSize int64 `json:"download_size,omitempty"`
+}
+
+// lastUsed returns when pk4 last made the source tree available.
+func (s *stamp) lastUsed() time.Time {
+	if s.LastUsed.IsZero() {
+		return s.Unpacked
+	}
+	return s.LastUsed
+}
+
+// stampPath returns the path of the stamp of the source tree outputDir.
+func stampPath(outputDir string) string {
+	return outputDir + ".pk4.json"
+}
+
+func readStamp(outputDir string) (*stamp, error) {
+	b, err := ioutil.ReadFile(stampPath(outputDir))
+	if err != nil {
+		return nil, err
+	}
+	var s stamp
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func writeStamp(outputDir string, s *stamp) error {
+	return write.Atomically(stampPath(outputDir), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(s)
+	})
+}
+
+// dscChecksums returns the SHA256 checksums of the .dsc file dscPath and all
+// files referenced by it, keyed by file name.
+func dscChecksums(dscPath string) (map[string]string, error) {
+	dsc, err := control.ParseDscFile(dscPath)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{dscPath}
+	for _, f := range dsc.Files {
+		paths = append(paths, filepath.Join(filepath.Dir(dscPath), f.Filename))
+	}
+	sums := make(map[string]string, len(paths))
+	for _, path := range paths {
+		sum, err := fileSha256(path)
+		if err != nil {
+			return nil, err
+		}
+		sums[filepath.Base(path)] = sum
+	}
+	return sums, nil
+}
+
+// goodSignatureRe matches the gpgv(1) output line printed by dscverify(1) for
+// a valid signature, e.g.:
+// gpgv: Good signature from "Michael Stapelberg <stapelberg@debian.org>"
+var goodSignatureRe = regexp.MustCompile(`(?m)Good signature from "([^"]+)"`)
+
+// parseSigner returns the signer from dscverify(1) output, if any.
+func parseSigner(out []byte) string {
+	matches := goodSignatureRe.FindSubmatch(out)
+	if matches == nil {
+		return ""
+	}
+	return string(matches[1])
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Debian/pk4/internal/snapshot"
+	"golang.org/x/sync/errgroup"
+	"pault.ag/go/debian/version"
+)
+
+// parallelDownloads limits how many source package versions -versions
+// downloads at the same time.
+const parallelDownloads = 4
+
+// versionConstraint is a single relation of a -versions range, e.g. >=1.2-1.
+type versionConstraint struct {
+	op      string
+	version version.Version
+}
+
+func (c versionConstraint) matches(v version.Version) bool {
+	cmp := version.Compare(v, c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">>", ">":
+		return cmp > 0
+	case "<<", "<":
+		return cmp < 0
+	case "=":
+		return cmp == 0
+	}
+	return false
+}
+
+// versionRange is a conjunction of version constraints.
+type versionRange []versionConstraint
+
+func (r versionRange) matches(v version.Version) bool {
+	for _, c := range r {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseVersionRange parses the value of the -versions flag, a comma-separated
+// list of relations (>=, <=, >>, <<, >, <, =) like in Debian control files.
+func parseVersionRange(s string) (versionRange, error) {
+	var r versionRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var op string
+		for _, candidate := range []string{">=", "<=", ">>", "<<", ">", "<", "="} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("invalid version constraint %q: must start with one of >=, <=, >>, <<, >, <, =", part)
+		}
+		v, err := version.Parse(strings.TrimSpace(strings.TrimPrefix(part, op)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %v", part, err)
+		}
+		r = append(r, versionConstraint{op: op, version: v})
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("empty version range %q", s)
+	}
+	return r, nil
+}
+
+// knownVersions returns all versions of srcpkg which snapshot.debian.org or the
+// pk4 index know about, sorted ascendingly.
+func (i *invocation) knownVersions(srcpkg string) ([]version.Version, error) {
+	seen := make(map[string]bool)
+	var versions []version.Version
+	add := func(s string) error {
+		if seen[s] {
+			return nil
+		}
+		seen[s] = true
+		v, err := version.Parse(s)
+		if err != nil {
+			return err
+		}
+		versions = append(versions, v)
+		return nil
+	}
+
+	if !i.offline {
+		snapshotVersions, err := i.snapshotClient().Versions(srcpkg)
+		if err != nil && err != snapshot.ErrNotFound {
+			return nil, err
+		}
+		for _, s := range snapshotVersions {
+			if err := add(s); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, srcversion, err := i.lookup("src:" + srcpkg); err == nil {
+		if err := add(srcversion); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(versions, func(a, b int) bool {
+		return version.Compare(versions[a], versions[b]) < 0
+	})
+	return versions, nil
+}
+
+// downloadVersions downloads all versions of srcpkg within the range spec and
+// returns their output directories, ordered by version.
+func (i *invocation) downloadVersions(srcpkg, spec string) ([]string, error) {
+	r, err := parseVersionRange(spec)
+	if err != nil {
+		return nil, err
+	}
+	known, err := i.knownVersions(srcpkg)
+	if err != nil {
+		return nil, err
+	}
+	var selected []version.Version
+	for _, v := range known {
+		if r.matches(v) {
+			selected = append(selected, v)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("none of the %d known versions of %s matches %q", len(known), srcpkg, spec)
+	}
+	i.V().Printf("downloading %d versions of %s: %v", len(selected), srcpkg, selected)
+
+	outputDirs := make([]string, len(selected))
+	sem := make(chan struct{}, parallelDownloads)
+	var eg errgroup.Group
+	for idx, v := range selected {
+		idx, v := idx, v // copy
+		eg.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			outputDir, err := i.download(srcpkg, v.String())
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", srcpkg, v, err)
+			}
+			outputDirs[idx] = outputDir
+			return nil
+		})
+	}
+	return outputDirs, eg.Wait()
+}
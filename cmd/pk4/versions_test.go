@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestVersionRange(t *testing.T) {
+	t.Parallel()
+
+	for _, entry := range []struct {
+		spec    string
+		version string
+		want    bool
+	}{
+		{">=1.2-1,<=1.4-2", "1.2-1", true},
+		{">=1.2-1,<=1.4-2", "1.3-1", true},
+		{">=1.2-1,<=1.4-2", "1.4-2", true},
+		{">=1.2-1,<=1.4-2", "1.4-2+deb10u1", false},
+		{">=1.2-1,<=1.4-2", "1.2~rc1-1", false},
+		{">>1.2-1", "1.2-1", false},
+		{">1.2-1", "1.2-1.1", true},
+		{"<<2:1.0", "1:9.9", true},
+		{"=1.2-1", "1.2-1", true},
+	} {
+		r, err := parseVersionRange(entry.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.matches(mustParseVersion(entry.version)); got != entry.want {
+			t.Errorf("parseVersionRange(%q).matches(%q) = %v, want %v", entry.spec, entry.version, got, entry.want)
+		}
+	}
+
+	for _, spec := range []string{"", "1.2-1", ">=", "~1.2"} {
+		if _, err := parseVersionRange(spec); err == nil {
+			t.Errorf("parseVersionRange(%q) unexpectedly succeeded", spec)
+		}
+	}
+}
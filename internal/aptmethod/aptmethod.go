@@ -0,0 +1,274 @@
+// Package aptmethod implements the client side of the protocol apt uses to talk
+// to its acquire methods (the programs in /usr/lib/apt/methods), see
+// /usr/share/doc/libapt-pkg-doc/method.html.
+//
+// Downloading files through apt’s methods gives pk4 the same transports (e.g.
+// tor+https://, s3://), credentials (/etc/apt/auth.conf.d) and proxy
+// configuration that apt itself uses.
+package aptmethod
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// message is a single protocol message, e.g.:
+//
+//	600 URI Acquire
+//	URI: http://deb.debian.org/debian/pool/main/h/hello/hello_2.10-1.dsc
+//	Filename: /tmp/hello_2.10-1.dsc
+type message struct {
+	code   int
+	text   string
+	fields []field
+}
+
+type field struct {
+	key, value string
+}
+
+func (m *message) get(key string) string {
+	for _, f := range m.fields {
+		if strings.EqualFold(f.key, key) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+func (m *message) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %s\n", m.code, m.text)
+	for _, f := range m.fields {
+		fmt.Fprintf(&buf, "%s: %s\n", f.key, f.value)
+	}
+	buf.WriteString("\n")
+	return buf.WriteTo(w)
+}
+
+func readMessage(r *bufio.Reader) (*message, error) {
+	var m *message
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && m != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if m == nil {
+			if line == "" {
+				continue // skip leading empty lines
+			}
+			idx := strings.IndexByte(line, ' ')
+			if idx == -1 {
+				idx = len(line)
+			}
+			code, err := strconv.Atoi(line[:idx])
+			if err != nil {
+				return nil, fmt.Errorf("malformed status line %q: %v", line, err)
+			}
+			m = &message{code: code, text: strings.TrimSpace(line[idx:])}
+			continue
+		}
+		if line == "" {
+			return m, nil
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed header line %q", line)
+		}
+		m.fields = append(m.fields, field{
+			key:   line[:idx],
+			value: strings.TrimSpace(line[idx+1:]),
+		})
+	}
+}
+
+// quote escapes s like apt’s QuoteString: bad characters, the percent sign and
+// all non-printable characters are replaced by %XX.
+func quote(s, bad string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' || c <= 0x20 || c >= 0x7f || strings.IndexByte(bad, c) > -1 {
+			fmt.Fprintf(&b, "%%%02x", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// FailureError is returned by Fetch when the method could not fetch a URI.
+type FailureError struct {
+	URI        string
+	Message    string
+	FailReason string
+}
+
+func (e *FailureError) Error() string {
+	if e.FailReason != "" {
+		return fmt.Sprintf("%s: %s (%s)", e.URI, e.Message, e.FailReason)
+	}
+	return fmt.Sprintf("%s: %s", e.URI, e.Message)
+}
+
+// NotFound returns whether the failure indicates that the URI does not exist.
+func (e *FailureError) NotFound() bool {
+	switch e.FailReason {
+	case "HttpError404", "HttpError410":
+		return true
+	}
+	return strings.Contains(strings.ToLower(e.Message), "not found")
+}
+
+// Method is a running apt acquire method.
+type Method struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	r     *bufio.Reader
+}
+
+// Start starts the acquire method at path and sends it config, which is a list
+// of apt configuration items in Key=Value format (see ParseConfig).
+func Start(path string, config []string) (*Method, error) {
+	cmd := exec.Command(path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	m := &Method{
+		cmd:   cmd,
+		stdin: stdin,
+		r:     bufio.NewReader(stdout),
+	}
+	capabilities, err := readMessage(m.r)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("%s: reading capabilities: %v", path, err)
+	}
+	if capabilities.code != 100 {
+		m.Close()
+		return nil, fmt.Errorf("%s: unexpected message %d %s, want 100 Capabilities", path, capabilities.code, capabilities.text)
+	}
+	if capabilities.get("Send-Config") == "true" && len(config) > 0 {
+		msg := message{code: 601, text: "Configuration"}
+		for _, item := range config {
+			idx := strings.IndexByte(item, '=')
+			if idx == -1 {
+				continue
+			}
+			msg.fields = append(msg.fields, field{
+				key:   "Config-Item",
+				value: quote(item[:idx], "=\"\n") + "=" + quote(item[idx+1:], "\n"),
+			})
+		}
+		if _, err := msg.WriteTo(m.stdin); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Fetch instructs the method to download uri to filename and waits until the
+// method is done.
+func (m *Method) Fetch(uri, filename string) error {
+	acquire := func(uri string) error {
+		msg := message{
+			code: 600,
+			text: "URI Acquire",
+			fields: []field{
+				{"URI", uri},
+				{"Filename", filename},
+			},
+		}
+		_, err := msg.WriteTo(m.stdin)
+		return err
+	}
+	if err := acquire(uri); err != nil {
+		return err
+	}
+	for {
+		msg, err := readMessage(m.r)
+		if err != nil {
+			return fmt.Errorf("%s: %v", uri, err)
+		}
+		switch msg.code {
+		case 101, 102, 200:
+			// Log, Status, URI Start: progress information only.
+
+		case 104:
+			// Warning, e.g. about weak hashes or from a proxy: not fatal.
+			log.Printf("%s: warning: %s", uri, msg.get("Message"))
+
+		case 351:
+			// Aux Request: the method asks apt to fetch another file first,
+			// which pk4 does not implement.
+			return fmt.Errorf("%s: the apt method requested the auxiliary file %s (351 Aux Request), which pk4 does not support", uri, msg.get("Aux-URI"))
+
+		case 103:
+			// Redirect: like apt, acquire the new URI instead.
+			uri = msg.get("New-URI")
+			if err := acquire(uri); err != nil {
+				return err
+			}
+
+		case 201:
+			return nil // URI Done
+
+		case 400, 401:
+			return &FailureError{
+				URI:        uri,
+				Message:    msg.get("Message"),
+				FailReason: msg.get("FailReason"),
+			}
+
+		default:
+			return fmt.Errorf("%s: unsupported message %d %s", uri, msg.code, msg.text)
+		}
+	}
+}
+
+// Close terminates the method by closing its standard input and waits for it
+// to exit.
+func (m *Method) Close() error {
+	m.stdin.Close()
+	return m.cmd.Wait()
+}
+
+// ParseConfig parses the output of apt-config dump into a list of
+// configuration items in Key=Value format.
+func ParseConfig(r io.Reader) ([]string, error) {
+	var items []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// e.g.: Acquire::http::Proxy "http://proxy:3128/";
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+		idx := strings.IndexByte(line, ' ')
+		if idx == -1 {
+			continue
+		}
+		value := strings.TrimSpace(line[idx+1:])
+		if len(value) < 2 || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+			continue
+		}
+		items = append(items, line[:idx]+"="+value[1:len(value)-1])
+	}
+	return items, scanner.Err()
+}
@@ -0,0 +1,91 @@
+package aptmethod
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "aptmethod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "hello_2.10-1.dsc")
+	if err := ioutil.WriteFile(src, []byte("Source: hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Start("testdata/fake", []string{"Test::Enabled=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	dest := filepath.Join(tmp, "dest.dsc")
+	if err := m.Fetch("fake:"+src, dest); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "Source: hello\n"; got != want {
+		t.Fatalf("unexpected file contents: got %q, want %q", got, want)
+	}
+
+	// The same method process handles more than one request:
+	err = m.Fetch("fake:"+filepath.Join(tmp, "nonexistant"), dest)
+	fe, ok := err.(*FailureError)
+	if !ok {
+		t.Fatalf("Fetch(nonexistant): got %v (%T), want *FailureError", err, err)
+	}
+	if !fe.NotFound() {
+		t.Fatalf("Fetch(nonexistant): NotFound() = false for %v", fe)
+	}
+
+	// Auxiliary files are not supported:
+	err = m.Fetch("fake:"+filepath.Join(tmp, "release.aux"), dest)
+	if err == nil || !strings.Contains(err.Error(), "351 Aux Request") {
+		t.Fatalf("Fetch(release.aux): got %v, want a 351 Aux Request error", err)
+	}
+}
+
+func TestFetchWithoutConfig(t *testing.T) {
+	m, err := Start("testdata/fake", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	err = m.Fetch("fake:/etc/hostname", "/dev/null")
+	if _, ok := err.(*FailureError); !ok {
+		t.Fatalf("Fetch: got %v (%T), want *FailureError", err, err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	const dump = `APT "";
+APT::Architecture "amd64";
+Acquire::http::Proxy "http://proxy.example:3128/";
+Dir::Etc::netrcparts "auth.conf.d";
+`
+	got, err := ParseConfig(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"APT=",
+		"APT::Architecture=amd64",
+		"Acquire::http::Proxy=http://proxy.example:3128/",
+		"Dir::Etc::netrcparts=auth.conf.d",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseConfig: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,150 @@
+// Package hooks runs the user-configured hook programs of pk4 and
+// pk4-replace, which are located in ~/.config/pk4/hooks-enabled/<point>/.
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Hook points, in the order in which they run.
+const (
+	AfterResolve   = "after-resolve"   // pk4: source package and version resolved
+	BeforeDownload = "before-download" // pk4: a non-zero exit status aborts
+	Unpack         = "unpack"          // pk4: replaces dpkg-source -x
+	AfterUnpack    = "after-unpack"    // pk4: source unpacked
+	AfterDownload  = "after-download"  // pk4: source downloaded and unpacked
+	BeforeReplace  = "before-replace"  // pk4-replace: a non-zero exit status aborts
+	AfterReplace   = "after-replace"   // pk4-replace: packages installed
+)
+
+// Points lists all hook points.
+var Points = []string{
+	AfterResolve,
+	BeforeDownload,
+	Unpack,
+	AfterUnpack,
+	AfterDownload,
+	BeforeReplace,
+	AfterReplace,
+}
+
+// DefaultTimeout is the time after which a hook is killed unless configured
+// otherwise.
+const DefaultTimeout = 10 * time.Minute
+
+// Env describes the source package a hook runs for. It is passed to hooks
+// as PK4_* environment variables.
+type Env struct {
+	Source    string // PK4_SOURCE, e.g. i3-wm
+	Version   string // PK4_VERSION, e.g. 4.13-1
+	Dsc       string // PK4_DSC, path to the .dsc file, if any
+	OutputDir string // PK4_OUTPUT_DIR, path to the unpacked source
+	Origin    string // PK4_ORIGIN, e.g. Debian, snapshot.debian.org/debian or dgit
+	Changes   string // PK4_CHANGES (pk4-replace only), path to the .changes file
+}
+
+func (e Env) environ(point string) []string {
+	return []string{
+		"PK4_HOOK=" + point,
+		"PK4_SOURCE=" + e.Source,
+		"PK4_VERSION=" + e.Version,
+		"PK4_DSC=" + e.Dsc,
+		"PK4_OUTPUT_DIR=" + e.OutputDir,
+		"PK4_ORIGIN=" + e.Origin,
+		"PK4_CHANGES=" + e.Changes,
+	}
+}
+
+// Executable returns an error if the hook at path cannot be executed, e.g.
+// because it lacks the executable bit or is a dangling symbolic link.
+func Executable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable (chmod +x?)", path)
+	}
+	return nil
+}
+
+// Runner runs the hooks in the hook point subdirectories of Dir.
+type Runner struct {
+	// Dir is the hooks-enabled directory, e.g. ~/.config/pk4/hooks-enabled.
+	Dir string
+
+	// Timeout is the maximum run time of each hook. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// Names returns the names of the hooks of point, in lexical order.
+func (r *Runner) Names(point string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(r.Dir, point))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Run runs all hooks of point in lexical order in the working directory wd,
+// passing args and env. It stops at the first failing hook. Hooks which are
+// not executable are skipped with a warning. found reports whether point has
+// any executable hooks.
+func (r *Runner) Run(point, wd string, env Env, args ...string) (found bool, _ error) {
+	names, err := r.Names(point)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		path := filepath.Join(r.Dir, point, name)
+		if err := Executable(path); err != nil {
+			log.Printf("skipping %s hook: %v", point, err)
+			continue
+		}
+		found = true
+		if err := r.run(path, point, wd, env, args); err != nil {
+			return true, err
+		}
+	}
+	return found, nil
+}
+
+func (r *Runner) run(path, point, wd string, env Env, args []string) error {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	hook := exec.CommandContext(ctx, path, args...)
+	hook.Dir = wd
+	hook.Env = append(os.Environ(), env.environ(point)...)
+	hook.Stderr = os.Stderr
+	hook.Stdout = os.Stderr
+	if err := hook.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s hook %s: timed out after %v", point, path, r.Timeout)
+		}
+		return fmt.Errorf("%s hook %s: %v", point, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeHook(t *testing.T, dir, name, script string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	log := filepath.Join(tmp, "log")
+	hookDir := filepath.Join(tmp, "hooks-enabled", AfterDownload)
+	// Created in reverse order to verify hooks run in lexical order.
+	writeHook(t, hookDir, "20-second", `echo "second $PK4_HOOK $PK4_SOURCE $PK4_VERSION $PK4_ORIGIN $*" >> `+log+"\n")
+	writeHook(t, hookDir, "10-first", `echo "first $PK4_OUTPUT_DIR $PK4_DSC $(pwd)" >> `+log+"\n")
+
+	r := Runner{Dir: filepath.Join(tmp, "hooks-enabled")}
+	env := Env{
+		Source:    "hello",
+		Version:   "2.10-2",
+		Dsc:       "/tmp/hello_2.10-2.dsc",
+		OutputDir: "/tmp/hello-2.10-2",
+		Origin:    "Debian",
+	}
+	found, err := r.Run(AfterDownload, tmp, env, "arg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("Run unexpectedly returned found == false")
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "first /tmp/hello-2.10-2 /tmp/hello_2.10-2.dsc " + tmp + "\n" +
+		"second after-download hello 2.10-2 Debian arg\n"
+	if got := string(b); got != want {
+		t.Fatalf("unexpected hook output: got %q, want %q", got, want)
+	}
+
+	found, err = r.Run(Unpack, tmp, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatalf("Run unexpectedly returned found == true for a hook point without hooks")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeHook(t, filepath.Join(tmp, AfterUnpack), "sleep", "exec sleep 10\n")
+	r := Runner{
+		Dir:     tmp,
+		Timeout: 100 * time.Millisecond,
+	}
+	_, err = r.Run(AfterUnpack, tmp, Env{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Run: got err %v, want timeout error", err)
+	}
+}
+
+func TestRunSkipsNonExecutable(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, Unpack)
+	writeHook(t, dir, "gbp", "exit 1\n")
+	if err := os.Chmod(filepath.Join(dir, "gbp"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "nonexistent"), filepath.Join(dir, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	r := Runner{Dir: tmp}
+	found, err := r.Run(Unpack, tmp, Env{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatalf("Run unexpectedly returned found == true when no hook is executable")
+	}
+}
+
+func TestManage(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "pk4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	system := filepath.Join(tmp, "system")
+	user := filepath.Join(tmp, "user")
+	writeHook(t, filepath.Join(system, AfterDownload), "git-init", "")
+	writeHook(t, filepath.Join(system, Unpack), "gbp", "")
+	writeHook(t, filepath.Join(user, Unpack), "gbp", "") // overrides system
+	writeHook(t, filepath.Join(user, AfterUnpack), "gbp", "")
+
+	available, err := Available(system, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range available {
+		got = append(got, h.Point+"/"+h.Name+" "+h.Path)
+	}
+	want := []string{
+		"unpack/gbp " + filepath.Join(user, Unpack, "gbp"),
+		"after-unpack/gbp " + filepath.Join(user, AfterUnpack, "gbp"),
+		"after-download/git-init " + filepath.Join(system, AfterDownload, "git-init"),
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected available hooks: got %q, want %q", got, want)
+	}
+
+	if _, err := Find(available, "gbp"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Fatalf("Find(gbp): got err %v, want ambiguity error", err)
+	}
+	h, err := Find(available, "git-init")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Runner{Dir: filepath.Join(tmp, "hooks-enabled")}
+	if err := r.Enable(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Enable(h); err != nil {
+		t.Fatalf("enabling an enabled hook: %v", err)
+	}
+	enabled, err := r.Enabled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enabled) != 1 || enabled[0] != h {
+		t.Fatalf("unexpected enabled hooks: got %+v, want [%+v]", enabled, h)
+	}
+	if err := r.Disable(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Disable(h); err == nil {
+		t.Fatalf("disabling a disabled hook unexpectedly succeeded")
+	}
+
+	// User-written hooks in hooks-enabled are not removed.
+	writeHook(t, filepath.Join(r.Dir, AfterDownload), "custom", "")
+	if err := r.Disable(Hook{Point: AfterDownload, Name: "custom"}); err == nil {
+		t.Fatalf("disabling a user-written hook unexpectedly succeeded")
+	}
+}
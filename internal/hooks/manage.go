@@ -0,0 +1,143 @@
+package hooks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Hook is a hook program in a hooks-available directory, which can be enabled
+// by symlinking it into the hooks-enabled directory.
+type Hook struct {
+	Point string // e.g. after-download
+	Name  string // e.g. git-init
+	Path  string // e.g. /usr/share/pk4/hooks-available/after-download/git-init
+}
+
+func pointIndex(point string) int {
+	for idx, p := range Points {
+		if p == point {
+			return idx
+		}
+	}
+	return len(Points)
+}
+
+// Available returns the hooks in the hooks-available directories dirs (e.g.
+// /usr/share/pk4/hooks-available and ~/.config/pk4/hooks-available), sorted by
+// hook point and name. Hooks in later directories override hooks with the same
+// hook point and name in earlier directories.
+func Available(dirs ...string) ([]Hook, error) {
+	byName := make(map[string]Hook)
+	for _, dir := range dirs {
+		for _, point := range Points {
+			fis, err := ioutil.ReadDir(filepath.Join(dir, point))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, fi := range fis {
+				byName[point+"/"+fi.Name()] = Hook{
+					Point: point,
+					Name:  fi.Name(),
+					Path:  filepath.Join(dir, point, fi.Name()),
+				}
+			}
+		}
+	}
+	hooks := make([]Hook, 0, len(byName))
+	for _, h := range byName {
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		if pi, pj := pointIndex(hooks[i].Point), pointIndex(hooks[j].Point); pi != pj {
+			return pi < pj
+		}
+		return hooks[i].Name < hooks[j].Name
+	})
+	return hooks, nil
+}
+
+// Find returns the hook called name from hooks. name may be qualified with
+// its hook point (e.g. after-download/git-init), which is required if hooks of
+// multiple hook points share the same name.
+func Find(hooks []Hook, name string) (Hook, error) {
+	var matches []Hook
+	for _, h := range hooks {
+		if h.Name == name || h.Point+"/"+h.Name == name {
+			matches = append(matches, h)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Hook{}, fmt.Errorf("hook %q not found", name)
+	case 1:
+		return matches[0], nil
+	}
+	qualified := make([]string, len(matches))
+	for idx, h := range matches {
+		qualified[idx] = h.Point + "/" + h.Name
+	}
+	return Hook{}, fmt.Errorf("hook name %q is ambiguous, specify one of %s", name, strings.Join(qualified, ", "))
+}
+
+// Enabled returns the hooks in the hooks-enabled directory r.Dir. Path is the
+// target of the symbolic link, if any.
+func (r *Runner) Enabled() ([]Hook, error) {
+	var enabled []Hook
+	for _, point := range Points {
+		names, err := r.Names(point)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			path := filepath.Join(r.Dir, point, name)
+			if target, err := os.Readlink(path); err == nil {
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(r.Dir, point, target)
+				}
+				path = target
+			}
+			enabled = append(enabled, Hook{Point: point, Name: name, Path: path})
+		}
+	}
+	return enabled, nil
+}
+
+// Enable symlinks h into the hooks-enabled directory r.Dir.
+func (r *Runner) Enable(h Hook) error {
+	if err := Executable(h.Path); err != nil {
+		return err
+	}
+	dir := filepath.Join(r.Dir, h.Point)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(dir, h.Name)
+	if target, err := os.Readlink(link); err == nil && target == h.Path {
+		return nil // already enabled
+	}
+	return os.Symlink(h.Path, link)
+}
+
+// Disable removes h from the hooks-enabled directory r.Dir. Only symbolic
+// links are removed, as hooks-enabled may contain user-written programs.
+func (r *Runner) Disable(h Hook) error {
+	path := filepath.Join(r.Dir, h.Point, h.Name)
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("hook %s/%s is not enabled", h.Point, h.Name)
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s is not a symbolic link, not removing it", path)
+	}
+	return os.Remove(path)
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type countingWriter struct {
@@ -86,7 +88,9 @@ func encode(w io.Writer, idx map[string]string) error {
 
 	// So that the length of the current block can be computed by looking at the
 	// offset of the next block:
-	sameLenOffsets[lengths[len(lengths)-1]+1] = cw.offset
+	if len(lengths) > 0 { // e.g. no debug Packages targets configured
+		sameLenOffsets[lengths[len(lengths)-1]+1] = cw.offset
+	}
 	for _, l := range lengths {
 		blockLen := sameLenOffsets[l+1] - sameLenOffsets[l]
 		blockOffset := sameLenOffsets[l]
@@ -101,7 +105,26 @@ func encode(w io.Writer, idx map[string]string) error {
 func (index URIs) Encode(w io.Writer) error {
 	idx := make(map[string]string, len(index))
 	for src, dsc := range index {
-		idx[fmt.Sprintf("%s\t%s", src.Package, src.Version)] = fmt.Sprintf("%s\t%d", dsc.URL, dsc.Size)
+		idx[fmt.Sprintf("%s\t%s", src.Package, src.Version)] = fmt.Sprintf("%s\t%d\t%s\t%s", dsc.URL, dsc.Size, dsc.Origin, dsc.Label)
+	}
+	return encode(w, idx)
+}
+
+func (index Debs) Encode(w io.Writer) error {
+	idx := make(map[string]string, len(index))
+	for src, debs := range index {
+		// All debs of a source package need to fit into one line.
+		fields := make([]string, 0, 6*len(debs))
+		for _, deb := range debs {
+			fields = append(fields,
+				deb.Package,
+				deb.Version,
+				deb.Architecture,
+				deb.URL,
+				deb.SHA256,
+				strconv.FormatInt(deb.Size, 10))
+		}
+		idx[fmt.Sprintf("%s\t%s", src.Package, src.Version)] = strings.Join(fields, "\t")
 	}
 	return encode(w, idx)
 }
@@ -10,14 +10,30 @@ type Source struct {
 type Index map[string]Source
 
 // DSC contains the URL to a DSC and the total file size of the DSC plus all
-// files it references.
+// files it references. Origin and Label identify the archive the DSC was found
+// in, as per the archive’s Release file.
 type DSC struct {
-	URL  string
-	Size int64
+	URL    string
+	Size   int64
+	Origin string
+	Label  string
 }
 
 type URIs map[Source]DSC
 
+// Deb describes a binary package (.deb file) built from a source package, as
+// per the Packages index of the archive it was found in.
+type Deb struct {
+	Package      string
+	Version      string
+	Architecture string
+	URL          string
+	SHA256       string
+	Size         int64
+}
+
+type Debs map[Source][]Deb
+
 // BlockLocation describes the location (including the size) of a same-length
 // block within an index file.
 type BlockLocation struct {
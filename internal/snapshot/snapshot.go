@@ -0,0 +1,337 @@
+// Package snapshot is a client for the machine-readable interface of
+// snapshot.debian.org, see https://salsa.debian.org/snapshot-team/snapshot/raw/master/API
+package snapshot
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Debian/pk4/internal/write"
+)
+
+// ErrNotFound is returned when snapshot.debian.org does not know the requested
+// package, version or file.
+var ErrNotFound = errors.New("not found on snapshot.debian.org")
+
+// FileInfo describes where a file can be found on snapshot.debian.org.
+type FileInfo struct {
+	Name        string `json:"name"`
+	ArchiveName string `json:"archive_name"`
+	Path        string `json:"path"`
+	FirstSeen   string `json:"first_seen"`
+	Size        int64  `json:"size"`
+}
+
+// SrcFiles lists the files of a source package version, keyed by their SHA1
+// hash.
+type SrcFiles struct {
+	Package  string                `json:"package"`
+	Version  string                `json:"version"`
+	Fileinfo map[string][]FileInfo `json:"fileinfo"`
+}
+
+// BinPackage is a binary package built from a source package.
+type BinPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// BinFile is a .deb file of a binary package version.
+type BinFile struct {
+	Hash         string `json:"hash"`
+	Architecture string `json:"architecture"`
+}
+
+// BinFiles lists the .deb files of a binary package version.
+type BinFiles struct {
+	Result   []BinFile             `json:"result"`
+	Fileinfo map[string][]FileInfo `json:"fileinfo"`
+}
+
+// Client talks to snapshot.debian.org. The zero value is not usable: at least
+// BaseURL must be set.
+type Client struct {
+	// BaseURL is the URL of the snapshot service, e.g.
+	// http://snapshot.debian.org/
+	BaseURL string
+
+	// CacheDir is the directory in which JSON responses are cached. Caching
+	// is disabled if CacheDir is empty.
+	CacheDir string
+
+	// MaxAge is how long cached responses which can change over time (e.g.
+	// the list of versions of a package) are used. Responses about a
+	// specific package version never change and are cached indefinitely.
+	MaxAge time.Duration
+
+	// MaxRetries is how often a request is retried when snapshot.debian.org
+	// asks pk4 to slow down (HTTP 429 or 503).
+	MaxRetries int
+
+	// HTTPClient is used for all requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	sleep func(time.Duration) // for testing
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// URL returns the URL of the path underneath BaseURL.
+func (c *Client) URL(elem ...string) string {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return ""
+	}
+	u.Path = path.Join(append([]string{u.Path}, elem...)...)
+	return u.String()
+}
+
+// ArchiveURL returns the URL of the archive root of archive (e.g. “debian”) as
+// of the specified timestamp (e.g. “20150322T153011Z”).
+func (c *Client) ArchiveURL(archive, timestamp string) string {
+	return c.URL("archive", archive, timestamp)
+}
+
+// FileURL returns the URL from which the file with the specified SHA1 hash can
+// be downloaded.
+func (c *Client) FileURL(hash string) string {
+	return c.URL("file", hash)
+}
+
+// gzipReadCloser closes both the gzip.Reader and the underlying body.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	err := g.Reader.Close()
+	if berr := g.body.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// Sources returns the (uncompressed) Sources index of suite/component in
+// archive, as it was at the specified timestamp (e.g. “20240301T000000Z”).
+// snapshot.debian.org serves the most recent archive state at or before
+// timestamp. The caller must close the returned io.ReadCloser.
+func (c *Client) Sources(archive, timestamp, suite, component string) (io.ReadCloser, error) {
+	u := c.URL("archive", archive, timestamp, "dists", suite, component, "source", "Sources.gz")
+	resp, err := c.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%q: %v", u, err)
+	}
+	return gzipReadCloser{Reader: gz, body: resp.Body}, nil
+}
+
+// retryAfter returns how long to wait before retrying as per the Retry-After
+// header of resp, or def if resp has no (valid) Retry-After header.
+func retryAfter(resp *http.Response, def time.Duration) time.Duration {
+	val := resp.Header.Get("Retry-After")
+	if val == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return time.Until(t)
+	}
+	return def
+}
+
+// Get requests u, retrying when snapshot.debian.org responds with HTTP 429
+// (Too Many Requests) or HTTP 503 (Service Unavailable). The caller must close
+// the response body.
+func (c *Client) Get(u string) (*http.Response, error) {
+	sleep := c.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	backoff := 1 * time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "pk4")
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return resp, nil
+
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			// Discard the Body (for Keep-Alive).
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if attempt >= c.MaxRetries {
+				return nil, fmt.Errorf("%q: unexpected HTTP status code: got %d, want %d (after %d retries)", u, resp.StatusCode, http.StatusOK, attempt)
+			}
+			sleep(retryAfter(resp, backoff))
+			backoff *= 2
+
+		case http.StatusNotFound:
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, ErrNotFound
+
+		default:
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("%q: unexpected HTTP status code: got %d, want %d", u, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func (c *Client) cachePath(u string) string {
+	h := sha256.Sum256([]byte(u))
+	return filepath.Join(c.CacheDir, hex.EncodeToString(h[:])+".json")
+}
+
+// getJSON decodes the JSON response for the machine-readable interface path
+// (e.g. /mr/package/hello/) into v. Responses are served from the cache if
+// possible. If mutable is true, cached responses are only used for MaxAge.
+func (c *Client) getJSON(p string, query url.Values, mutable bool, v interface{}) error {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + p // keep trailing slashes
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	if c.CacheDir == "" {
+		return c.fetchJSON(u.String(), v)
+	}
+
+	cachePath := c.cachePath(u.String())
+	if st, err := os.Stat(cachePath); err == nil && (!mutable || time.Since(st.ModTime()) < c.MaxAge) {
+		b, err := ioutil.ReadFile(cachePath)
+		if err == nil && json.Unmarshal(b, v) == nil {
+			return nil
+		}
+		// corrupt cache entry: fall through and refresh it
+	}
+
+	resp, err := c.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%q: %v", u.String(), err)
+	}
+	if err := os.MkdirAll(c.CacheDir, 0755); err != nil {
+		return err
+	}
+	return write.Atomically(cachePath, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+func (c *Client) fetchJSON(u string, v interface{}) error {
+	resp, err := c.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%q: %v", u, err)
+	}
+	return nil
+}
+
+// Versions returns all versions of source package srcpkg which
+// snapshot.debian.org knows about.
+func (c *Client) Versions(srcpkg string) ([]string, error) {
+	var reply struct {
+		Result []struct {
+			Version string `json:"version"`
+		} `json:"result"`
+	}
+	if err := c.getJSON("/mr/package/"+srcpkg+"/", nil, true, &reply); err != nil {
+		return nil, err
+	}
+	versions := make([]string, len(reply.Result))
+	for idx, r := range reply.Result {
+		versions[idx] = r.Version
+	}
+	return versions, nil
+}
+
+// SrcFiles returns the files of source package srcpkg in srcversion.
+func (c *Client) SrcFiles(srcpkg, srcversion string) (*SrcFiles, error) {
+	var srcfiles SrcFiles
+	query := url.Values{"fileinfo": []string{"1"}}
+	if err := c.getJSON("/mr/package/"+srcpkg+"/"+srcversion+"/srcfiles", query, false, &srcfiles); err != nil {
+		return nil, err
+	}
+	return &srcfiles, nil
+}
+
+// BinPackages returns the binary packages built from source package srcpkg in
+// srcversion.
+func (c *Client) BinPackages(srcpkg, srcversion string) ([]BinPackage, error) {
+	var reply struct {
+		Result []BinPackage `json:"result"`
+	}
+	if err := c.getJSON("/mr/package/"+srcpkg+"/"+srcversion+"/binpackages", nil, false, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Result, nil
+}
+
+// BinFiles returns the .deb files of binary package binpkg in binversion, for
+// all architectures.
+func (c *Client) BinFiles(binpkg, binversion string) (*BinFiles, error) {
+	var binfiles BinFiles
+	query := url.Values{"fileinfo": []string{"1"}}
+	if err := c.getJSON("/mr/binary/"+binpkg+"/"+binversion+"/binfiles", query, false, &binfiles); err != nil {
+		return nil, err
+	}
+	return &binfiles, nil
+}
+
+// FileInfo returns where the file with the specified SHA1 hash can be found.
+func (c *Client) FileInfo(hash string) ([]FileInfo, error) {
+	var reply struct {
+		Result []FileInfo `json:"result"`
+	}
+	if err := c.getJSON("/mr/file/"+hash+"/info", nil, false, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Result, nil
+}
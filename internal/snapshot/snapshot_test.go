@@ -0,0 +1,110 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const srcfilesResponse = `{"_comment": "foo", "version": "2.10-1", "result": [{"hash": "58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58"}], "fileinfo": {"58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58": [{"name": "hello_2.10-1.dsc", "archive_name": "debian", "path": "/pool/main/h/hello", "first_seen": "20150322T153011Z", "size": 1323}]}, "package": "hello"}`
+
+func TestSrcFilesCached(t *testing.T) {
+	t.Parallel()
+
+	cacheDir, err := ioutil.TempDir("", "snapshottest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mr/package/hello/2.10-1/srcfiles", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.FormValue("fileinfo") != "1" {
+			http.Error(w, "expected ?fileinfo=1", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(srcfilesResponse))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &Client{
+		BaseURL:  ts.URL + "/",
+		CacheDir: cacheDir,
+	}
+	want := []FileInfo{
+		{
+			Name:        "hello_2.10-1.dsc",
+			ArchiveName: "debian",
+			Path:        "/pool/main/h/hello",
+			FirstSeen:   "20150322T153011Z",
+			Size:        1323,
+		},
+	}
+	for n := 0; n < 2; n++ {
+		srcfiles, err := c.SrcFiles("hello", "2.10-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := srcfiles.Fileinfo["58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58"]
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected fileinfo: got %+v, want %+v", got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&requests), int32(1); got != want {
+		t.Fatalf("unexpected number of requests: got %d, want %d", got, want)
+	}
+}
+
+func TestVersionsRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mr/package/hello/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"_comment": "foo", "package": "hello", "result": [{"version": "2.10-2"}, {"version": "2.10-1"}]}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var slept []time.Duration
+	c := &Client{
+		BaseURL:    ts.URL + "/",
+		MaxRetries: 1,
+		sleep:      func(d time.Duration) { slept = append(slept, d) },
+	}
+	got, err := c.Versions("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2.10-2", "2.10-1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected versions: got %q, want %q", got, want)
+	}
+	if want := []time.Duration{7 * time.Second}; !reflect.DeepEqual(slept, want) {
+		t.Fatalf("unexpected sleeps: got %v, want %v", slept, want)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL + "/"}
+	if _, err := c.FileInfo("58d7c33cffb9ccda8f31781b7c9be0c4f6d1cb58"); err != ErrNotFound {
+		t.Fatalf("FileInfo: got %v, want %v", err, ErrNotFound)
+	}
+}